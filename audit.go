@@ -0,0 +1,88 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// auditFile records every request sent along with the server's response.
+type auditFile struct {
+	file *recordFile
+}
+
+// auditRecord is a single record in the audit file.
+type auditRecord struct {
+	Timestamp string       `json:"ts"`
+	Input     interface{}  `json:"input"`
+	Request   auditRequest `json:"request"`
+	Status    int          `json:"status"`
+	Response  interface{}  `json:"response"`
+	Error     string       `json:"error,omitempty"`
+}
+
+// auditRequest describes a request in an audit record, with sensitive
+// header values redacted.
+type auditRequest struct {
+	Method  string            `json:"method"`
+	URL     string            `json:"url"`
+	Headers map[string]string `json:"headers"`
+}
+
+// openAuditFile opens path for appending.
+func openAuditFile(path string) (*auditFile, error) {
+	f, err := openRecordFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("opening audit file: %w", err)
+	}
+	return &auditFile{file: f}, nil
+}
+
+// record writes an audit record for a line whose request was sent. Lines
+// that failed before sending a request aren't recorded.
+func (a *auditFile) record(env map[string]interface{}, result lineResult, lineErr error) error {
+	if result.request == nil {
+		return nil
+	}
+
+	record := auditRecord{
+		Timestamp: time.Now().UTC().Format(time.RFC3339Nano),
+		Input:     env["input"],
+		Request:   describeRequest(result.request),
+		Status:    result.status,
+	}
+	if result.status != 0 {
+		record.Response = parseResponseBody(result.response)
+	}
+	if lineErr != nil {
+		record.Error = lineErr.Error()
+	}
+
+	// Records are written whole, so those from concurrent runs appending
+	// to the same file aren't interleaved
+	data, err := json.Marshal(record)
+	if err != nil {
+		return err
+	}
+	return a.file.write(append(data, '\n'))
+}
+
+// describeRequest returns the method, URL, and redacted headers of req.
+func describeRequest(req *http.Request) auditRequest {
+	headers := make(map[string]string, len(req.Header))
+	for name, values := range req.Header {
+		headers[name] = displayHeader(name, strings.Join(values, ", "))
+	}
+	return auditRequest{Method: req.Method, URL: req.URL.String(), Headers: headers}
+}
+
+// Flush writes any buffered audit records.
+func (a *auditFile) Flush() error {
+	return a.file.Flush()
+}
+
+func (a *auditFile) Close() error {
+	return a.file.Close()
+}
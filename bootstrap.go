@@ -0,0 +1,57 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+)
+
+// bootstrapValue is exposed to every line's expressions as bootstrap.
+var bootstrapValue interface{}
+
+// runBootstrap sends a GET request to url with the --token-file bearer
+// token and headers, and returns its response, parsed as JSON if possible,
+// or the result of evaluating extract against it.
+func runBootstrap(ctx context.Context, client *http.Client, url string, headers []*compiledExpression, extract *compiledExpression) (interface{}, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return nil, fmt.Errorf("creating request: %w", err)
+	}
+	if bearerToken != nil {
+		token, err := bearerToken.read()
+		if err != nil {
+			return nil, err
+		}
+		setHeader(req.Header, "Authorization", "Bearer "+token)
+	}
+	env := map[string]interface{}{"env": getEnvMap()}
+	if err := setHeaders(req.Header, headers, env); err != nil {
+		return nil, err
+	}
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, fmt.Errorf("reading response: %w", err)
+	}
+	if resp.StatusCode >= 400 {
+		return nil, fmt.Errorf("%s returned %s", url, resp.Status)
+	}
+
+	response := parseResponseBody(body)
+	if extract == nil {
+		return response, nil
+	}
+	env["response"] = response
+	env["status"] = resp.StatusCode
+	value, err := extract.evaluate(env)
+	if err != nil {
+		return nil, fmt.Errorf("evaluating bootstrap expression: %w", err)
+	}
+	return value, nil
+}
@@ -0,0 +1,60 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+)
+
+// carriedHeader is a response header to copy onto the next request,
+// possibly under a different name, like ETag=If-Match.
+type carriedHeader struct {
+	response string
+	request  string
+}
+
+// carried holds the values of the --carry-header headers from the latest
+// response that had them, by request header name. It's guarded by
+// lineStateMu.
+var carried = make(map[string]string)
+
+// parseCarriedHeaders parses --carry-header values of the form NAME or
+// RESPONSE-NAME=REQUEST-NAME.
+func parseCarriedHeaders(values []string) ([]carriedHeader, error) {
+	var headers []carriedHeader
+	for _, value := range values {
+		response, request, renamed := strings.Cut(value, "=")
+		response, request = strings.TrimSpace(response), strings.TrimSpace(request)
+		if !renamed {
+			request = response
+		}
+		if response == "" || request == "" {
+			return nil, fmt.Errorf("invalid --carry-header %q", value)
+		}
+		headers = append(headers, carriedHeader{response: response, request: request})
+	}
+	return headers, nil
+}
+
+// carriedFrom returns the values of the carried headers present in resp,
+// for the next request. Headers the response doesn't have keep their
+// previous values.
+func carriedFrom(headers []carriedHeader, resp *http.Response) map[string]string {
+	values := make(map[string]string)
+	for _, h := range headers {
+		if value := resp.Header.Get(h.response); value != "" {
+			values[h.request] = value
+		}
+	}
+	return values
+}
+
+// setCarriedHeaders sets the headers carried from earlier responses on a
+// request.
+func setCarriedHeaders(header http.Header) {
+	lineStateMu.Lock()
+	defer lineStateMu.Unlock()
+	for name, value := range carried {
+		setHeader(header, name, value)
+	}
+}
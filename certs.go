@@ -0,0 +1,97 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+)
+
+// clientCerts holds the client certificates to present for mutual TLS:
+// one per host from --cert-host, and the --cert/--key default for every
+// other host.
+type clientCerts struct {
+	hosts    map[string]*tls.Certificate
+	fallback *tls.Certificate
+}
+
+// loadClientCerts loads the default certificate from certFile and keyFile,
+// if given, and one for each host=cert.pem,key.pem mapping. A mapping
+// without a key file reads the key from the certificate file.
+func loadClientCerts(certFile, keyFile string, mappings []string) (*clientCerts, error) {
+	certs := &clientCerts{hosts: make(map[string]*tls.Certificate, len(mappings))}
+	if certFile != "" {
+		cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+		if err != nil {
+			return nil, fmt.Errorf("--cert: %w", err)
+		}
+		certs.fallback = &cert
+	}
+	for _, mapping := range mappings {
+		host, files, ok := strings.Cut(mapping, "=")
+		host = strings.ToLower(strings.TrimSpace(host))
+		if !ok || host == "" || files == "" {
+			return nil, fmt.Errorf("--cert-host: expected host=cert.pem,key.pem, got %q", mapping)
+		}
+		// An IPv6 address without a port can be given with or without its
+		// brackets
+		if _, _, err := net.SplitHostPort(host); err != nil {
+			host = strings.Trim(host, "[]")
+		}
+		if _, ok := certs.hosts[host]; ok {
+			return nil, fmt.Errorf("--cert-host: %s is given more than once", host)
+		}
+		certPath, keyPath, ok := strings.Cut(files, ",")
+		if !ok {
+			keyPath = certPath
+		}
+		cert, err := tls.LoadX509KeyPair(strings.TrimSpace(certPath), strings.TrimSpace(keyPath))
+		if err != nil {
+			return nil, fmt.Errorf("--cert-host %s: %w", host, err)
+		}
+		certs.hosts[host] = &cert
+	}
+	return certs, nil
+}
+
+// certHostKey is the context key under which certRoundTripper records the
+// host a request is for, so the TLS handshake can pick its certificate.
+type certHostKey struct{}
+
+// certRoundTripper records each request's host in its context before
+// passing it on. The context is the one the connection's TLS handshake is
+// made with, which is how clientCerts.get knows the host: the handshake
+// callback isn't otherwise told which server it's talking to.
+type certRoundTripper struct {
+	next http.RoundTripper
+}
+
+func (t certRoundTripper) RoundTrip(req *http.Request) (*http.Response, error) {
+	ctx := context.WithValue(req.Context(), certHostKey{}, req.URL.Host)
+	return t.next.RoundTrip(req.WithContext(ctx))
+}
+
+// get is a tls.Config.GetClientCertificate callback returning the
+// certificate for the host being connected to, matched on host:port and
+// then on the host alone, or the default certificate. With neither, no
+// certificate is sent.
+func (c *clientCerts) get(info *tls.CertificateRequestInfo) (*tls.Certificate, error) {
+	if host, ok := info.Context().Value(certHostKey{}).(string); ok {
+		host = strings.ToLower(host)
+		if cert, ok := c.hosts[host]; ok {
+			return cert, nil
+		}
+		if name, _, err := net.SplitHostPort(host); err == nil {
+			host = name
+		}
+		if cert, ok := c.hosts[strings.Trim(host, "[]")]; ok {
+			return cert, nil
+		}
+	}
+	if c.fallback != nil {
+		return c.fallback, nil
+	}
+	return &tls.Certificate{}, nil
+}
@@ -0,0 +1,70 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// checkpointFile records how many input lines have been finished, so that
+// a later run with --resume can skip them.
+type checkpointFile struct {
+	path  string
+	every int64 // lines between saves
+	done  int64 // lines finished
+	saved int64 // lines finished as of the last save
+}
+
+// readCheckpoint returns the number of lines finished according to the
+// checkpoint at path, or 0 if there isn't one yet.
+func readCheckpoint(path string) (int64, error) {
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return 0, nil
+	} else if err != nil {
+		return 0, fmt.Errorf("reading checkpoint: %w", err)
+	}
+	done, err := strconv.ParseInt(strings.TrimSpace(string(data)), 10, 64)
+	if err != nil || done < 0 {
+		return 0, fmt.Errorf("checkpoint file %s doesn't hold a line count", path)
+	}
+	return done, nil
+}
+
+// finished records that the first n lines have been finished, saving the
+// checkpoint every c.every lines.
+func (c *checkpointFile) finished(n int64) error {
+	c.done = n
+	if c.done-c.saved >= c.every {
+		return c.save()
+	}
+	return nil
+}
+
+// save writes the number of lines finished. The file is replaced in one
+// step, so a crash while saving leaves the previous checkpoint intact.
+func (c *checkpointFile) save() error {
+	if c.done == c.saved {
+		return nil
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(c.path), filepath.Base(c.path)+".*")
+	if err != nil {
+		return fmt.Errorf("saving checkpoint: %w", err)
+	}
+	_, err = fmt.Fprintf(tmp, "%d\n", c.done)
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Rename(tmp.Name(), c.path)
+	}
+	if err != nil {
+		os.Remove(tmp.Name())
+		return fmt.Errorf("saving checkpoint: %w", err)
+	}
+	c.saved = c.done
+	return nil
+}
@@ -0,0 +1,154 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/spf13/cobra"
+	"github.com/spf13/pflag"
+	"gopkg.in/yaml.v3"
+)
+
+const defaultConfigFile = ".pub.yaml"
+
+// The annotations cobra records flag groups under
+const (
+	mutuallyExclusiveAnnotation = "cobra_annotation_mutually_exclusive"
+	requiredTogetherAnnotation  = "cobra_annotation_required_if_others_set"
+)
+
+// configured records the flags whose values came from the config file.
+// They aren't marked as changed, so checks for flags given on the command
+// line don't see them.
+var configured = make(map[string]bool)
+
+// loadConfig applies flag defaults from a YAML config file. Keys are flag
+// names; flags given on the command line take precedence. Without --config,
+// ~/.pub.yaml is used if it exists.
+func loadConfig(cmd *cobra.Command, args []string) error {
+	path := configFile
+	if path == "" {
+		home, err := os.UserHomeDir()
+		if err != nil {
+			return nil
+		}
+		path = filepath.Join(home, defaultConfigFile)
+		if _, err := os.Stat(path); errors.Is(err, os.ErrNotExist) {
+			return nil
+		}
+	}
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return fmt.Errorf("reading config file: %w", err)
+	}
+
+	var values map[string]interface{}
+	if err := yaml.Unmarshal(data, &values); err != nil {
+		return fmt.Errorf("parsing config file %s: %w", path, err)
+	}
+
+	flags := cmd.Flags()
+	names := make([]string, 0, len(values))
+	for name := range values {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	// Values from the file are defaults, so they're skipped for flags in a
+	// mutually exclusive group with one given on the command line, and two
+	// from the same group in the file are an error
+	fromFile := make(map[string]string)
+	for _, name := range names {
+		flag := flags.Lookup(name)
+		if flag == nil || name == "config" {
+			return fmt.Errorf("config file %s: unknown flag %q", path, name)
+		}
+		if flag.Changed {
+			continue
+		}
+		overridden := false
+		for _, group := range flag.Annotations[mutuallyExclusiveAnnotation] {
+			for _, other := range strings.Fields(group) {
+				if flags.Lookup(other).Changed {
+					overridden = true
+				}
+			}
+		}
+		if overridden {
+			continue
+		}
+		for _, group := range flag.Annotations[mutuallyExclusiveAnnotation] {
+			if previous, ok := fromFile[group]; ok {
+				return fmt.Errorf("config file %s: flags %q and %q can't be used together", path, previous, name)
+			}
+			fromFile[group] = name
+		}
+
+		if err := applyConfigValue(flag, values[name]); err != nil {
+			return fmt.Errorf("config file %s: flag %q: %w", path, name, err)
+		}
+		configured[name] = true
+	}
+
+	// A flag given on the command line whose group requires others can be
+	// completed by the file, so the file's flags in that group count as set
+	for name := range configured {
+		flag := flags.Lookup(name)
+		for _, group := range flag.Annotations[requiredTogetherAnnotation] {
+			for _, other := range strings.Fields(group) {
+				if flags.Lookup(other).Changed {
+					flag.Changed = true
+				}
+			}
+		}
+	}
+
+	return nil
+}
+
+// applyConfigValue sets flag to a value from the config file, as its
+// default rather than as if it were given on the command line. Each
+// element of a list is applied in turn, and a map is given in the
+// key=value,... form of map flags.
+func applyConfigValue(flag *pflag.Flag, value interface{}) error {
+	kind := flag.Value.Type()
+	multiple := strings.HasSuffix(kind, "Array") || strings.HasSuffix(kind, "Slice") || strings.HasPrefix(kind, "stringTo")
+
+	var list []interface{}
+	switch v := value.(type) {
+	case []interface{}:
+		if !multiple {
+			return fmt.Errorf("does not accept a list")
+		}
+		list = v
+	case map[string]interface{}:
+		if !strings.HasPrefix(kind, "stringTo") {
+			return fmt.Errorf("does not accept a map")
+		}
+		keys := make([]string, 0, len(v))
+		for key := range v {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+		pairs := make([]string, len(keys))
+		for i, key := range keys {
+			pairs[i] = fmt.Sprintf("%s=%v", key, v[key])
+		}
+		list = []interface{}{strings.Join(pairs, ",")}
+	default:
+		list = []interface{}{value}
+	}
+
+	for _, v := range list {
+		if err := flag.Value.Set(fmt.Sprintf("%v", v)); err != nil {
+			return err
+		}
+	}
+	flag.DefValue = flag.Value.String()
+	return nil
+}
@@ -0,0 +1,66 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+)
+
+// confirmRequest shows a request on the terminal and asks whether to send
+// it, returning an error unless the answer is yes. Input is usually piped
+// in, so the prompt is read from the controlling terminal rather than
+// stdin.
+func confirmRequest(req *http.Request, requestID string, body []byte) error {
+	tty, err := os.OpenFile("/dev/tty", os.O_RDWR, 0)
+	if err != nil {
+		return fmt.Errorf("--confirm needs a terminal to prompt on; use --yes to skip the prompt")
+	}
+	defer tty.Close()
+
+	printRequest(tty, req, requestID, body)
+	fmt.Fprintf(tty, "Proceed? [y/N] ")
+	answer, err := bufio.NewReader(tty).ReadString('\n')
+	if err != nil {
+		return fmt.Errorf("reading confirmation: %w", err)
+	}
+	switch strings.ToLower(strings.TrimSpace(answer)) {
+	case "y", "yes":
+		return nil
+	}
+	return fmt.Errorf("not confirmed")
+}
+
+// checkTerminal returns an error for flag if there's no terminal to prompt
+// on, so that the run stops before anything is sent rather than at the
+// prompt.
+func checkTerminal(flag string) error {
+	tty, err := os.OpenFile("/dev/tty", os.O_RDWR, 0)
+	if err != nil {
+		return fmt.Errorf("%s needs a terminal to prompt on; use --yes to skip the prompt", flag)
+	}
+	return tty.Close()
+}
+
+// confirmContinue reports how the first requests of a --confirm-after run
+// went and asks whether to send the rest, returning an error unless the
+// answer is yes.
+func confirmContinue(sent, failed int) error {
+	tty, err := os.OpenFile("/dev/tty", os.O_RDWR, 0)
+	if err != nil {
+		return fmt.Errorf("--confirm-after needs a terminal to prompt on; use --yes to skip the prompt")
+	}
+	defer tty.Close()
+
+	fmt.Fprintf(tty, "Sent %d requests: %d succeeded, %d failed. Send the rest? [y/N] ", sent, sent-failed, failed)
+	answer, err := bufio.NewReader(tty).ReadString('\n')
+	if err != nil {
+		return fmt.Errorf("reading confirmation: %w", err)
+	}
+	switch strings.ToLower(strings.TrimSpace(answer)) {
+	case "y", "yes":
+		return nil
+	}
+	return fmt.Errorf("not confirmed after the first %d requests", sent)
+}
@@ -0,0 +1,153 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// deadLetterFile records failed lines so they can be reviewed or replayed.
+type deadLetterFile struct {
+	file *recordFile
+
+	// Outcomes to record. With neither set, every failure is recorded.
+	statuses statusRanges
+	filter   *compiledExpression
+
+	// Record format: "raw", "json", or an expression
+	format     string
+	formatExpr *compiledExpression
+}
+
+// deadLetter is a single record in the json dead-letter format.
+type deadLetter struct {
+	Timestamp string      `json:"timestamp"`
+	Input     interface{} `json:"input"`
+	Error     string      `json:"error"`
+	Status    int         `json:"status,omitempty"`
+	Response  string      `json:"response,omitempty"`
+}
+
+// compileDeadLetters prepares the dead-letter file to be opened. on is a
+// list of statuses or an expression over the response that selects which
+// failures are recorded, and format is how each record is written.
+func compileDeadLetters(on string, format string) (*deadLetterFile, error) {
+	d := &deadLetterFile{format: format}
+
+	if strings.TrimSpace(on) != "" {
+		statuses, err := parseStatusRanges(strings.Split(on, ","))
+		if err == nil {
+			d.statuses = statuses
+		} else {
+			d.filter, err = compileExpression(on, responseExprEnv)
+			if err != nil {
+				return nil, fmt.Errorf("compiling dead-letter-on expression: %w", err)
+			}
+		}
+	}
+
+	if format != "raw" && format != "json" {
+		var err error
+		d.formatExpr, err = compileExpression(format, deadLetterExprEnv)
+		if err != nil {
+			return nil, fmt.Errorf("compiling dead-letter-format expression: %w", err)
+		}
+	}
+
+	return d, nil
+}
+
+// open opens path for appending the dead letters.
+func (d *deadLetterFile) open(path string) error {
+	f, err := openRecordFile(path)
+	if err != nil {
+		return fmt.Errorf("opening dead-letter file: %w", err)
+	}
+	d.file = f
+	return nil
+}
+
+// expressions returns the --dead-letter-on and --dead-letter-format
+// expressions that are set.
+func (d *deadLetterFile) expressions() []*compiledExpression {
+	if d == nil {
+		return nil
+	}
+	return []*compiledExpression{d.filter, d.formatExpr}
+}
+
+// record writes a dead letter for a failed line if the outcome matches the
+// dead-letter filter. raw is the original input line and env the line's
+// expression variables.
+func (d *deadLetterFile) record(raw string, env map[string]interface{}, result lineResult, lineErr error) error {
+	ok, err := d.matches(env, result)
+	if err != nil || !ok {
+		return err
+	}
+
+	line, err := d.formatRecord(raw, env, result, lineErr)
+	if err != nil {
+		return err
+	}
+	return d.file.write([]byte(line + "\n"))
+}
+
+// formatRecord renders the dead-letter record for a failed line.
+func (d *deadLetterFile) formatRecord(raw string, env map[string]interface{}, result lineResult, lineErr error) (string, error) {
+	switch {
+	case d.formatExpr != nil:
+		recordEnv := withResponse(env, result.status, result.response)
+		recordEnv["error"] = lineErr.Error()
+		value, err := d.formatExpr.evaluate(recordEnv)
+		if err != nil {
+			return "", fmt.Errorf("evaluating dead-letter-format expression: %w", err)
+		}
+		if s, isString := value.(string); isString {
+			return s, nil
+		}
+		data, err := json.Marshal(value)
+		return string(data), err
+	case d.format == "json":
+		data, err := json.Marshal(deadLetter{
+			Timestamp: time.Now().UTC().Format(time.RFC3339Nano),
+			Input:     env["input"],
+			Error:     lineErr.Error(),
+			Status:    result.status,
+			Response:  string(result.response),
+		})
+		return string(data), err
+	}
+	return raw, nil
+}
+
+func (d *deadLetterFile) matches(env map[string]interface{}, result lineResult) (bool, error) {
+	switch {
+	case d.statuses != nil:
+		return d.statuses.contains(result.status), nil
+	case d.filter != nil:
+		// Failures without a response can't match a response expression
+		if result.status == 0 {
+			return false, nil
+		}
+		matched, err := d.filter.evaluate(withResponse(env, result.status, result.response))
+		if err != nil {
+			return false, fmt.Errorf("evaluating dead-letter-on expression: %w", err)
+		}
+		b, isBool := matched.(bool)
+		if !isBool {
+			return false, fmt.Errorf("dead-letter-on expression returned %T, not bool", matched)
+		}
+		return b, nil
+	}
+	return true, nil
+}
+
+// Flush writes any buffered dead letters.
+func (d *deadLetterFile) Flush() error {
+	return d.file.Flush()
+}
+
+func (d *deadLetterFile) Close() error {
+	return d.file.Close()
+}
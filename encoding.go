@@ -0,0 +1,60 @@
+package main
+
+import (
+	"bytes"
+	"compress/flate"
+	"compress/gzip"
+	"compress/zlib"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strings"
+
+	"github.com/andybalholm/brotli"
+)
+
+// decodeResponse undoes the Content-Encoding of a response body, so that
+// it can be printed and parsed. Go's transport already decodes gzip when it
+// asked for it, so this only applies when a header like Accept-Encoding was
+// set explicitly. A response with an unknown encoding is returned as is,
+// with a warning.
+func decodeResponse(resp *http.Response, body []byte) ([]byte, error) {
+	header := resp.Header.Get("Content-Encoding")
+	if header == "" || len(body) == 0 {
+		return body, nil
+	}
+
+	// Encodings are listed in the order they were applied
+	encodings := strings.Split(header, ",")
+	for i := len(encodings) - 1; i >= 0; i-- {
+		encoding := strings.ToLower(strings.TrimSpace(encodings[i]))
+		var r io.Reader
+		var err error
+		switch encoding {
+		case "", "identity":
+			continue
+		case "gzip", "x-gzip":
+			r, err = gzip.NewReader(bytes.NewReader(body))
+		case "deflate":
+			// deflate is meant to be zlib-wrapped, but some servers send
+			// raw DEFLATE data
+			r, err = zlib.NewReader(bytes.NewReader(body))
+			if err != nil {
+				r, err = flate.NewReader(bytes.NewReader(body)), nil
+			}
+		case "br":
+			r = brotli.NewReader(bytes.NewReader(body))
+		default:
+			fmt.Fprintf(os.Stderr, "Warning: not decoding response with unknown Content-Encoding %q\n", header)
+			return body, nil
+		}
+		if err == nil {
+			body, err = io.ReadAll(r)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("decoding %s response: %w", encoding, err)
+		}
+	}
+	return body, nil
+}
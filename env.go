@@ -0,0 +1,32 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+)
+
+// dotenvFiles are the dotenv files loaded into the environment at startup.
+var dotenvFiles []string
+
+// printEnvironment writes the dotenv files that were loaded and the names,
+// but not the values, of the variables available to expressions as env.
+func printEnvironment(w io.Writer) {
+	if len(dotenvFiles) == 0 {
+		fmt.Fprintf(w, "Dotenv files: none\n")
+	} else {
+		fmt.Fprintf(w, "Dotenv files: %s\n", strings.Join(dotenvFiles, ", "))
+	}
+
+	env := getEnvMap()
+	names := make([]string, 0, len(env))
+	for name := range env {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	fmt.Fprintf(w, "Environment variables (%d):\n", len(names))
+	for _, name := range names {
+		fmt.Fprintf(w, "  %s\n", name)
+	}
+}
@@ -0,0 +1,100 @@
+package main
+
+import (
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// lookupPath returns the value at a dotted path like "data.items.0.id"
+// within a parsed JSON value. Numeric segments index into arrays.
+func lookupPath(value interface{}, path string) (interface{}, bool) {
+	for _, segment := range strings.Split(path, ".") {
+		switch v := value.(type) {
+		case map[string]interface{}:
+			var ok bool
+			if value, ok = v[segment]; !ok {
+				return nil, false
+			}
+		case []interface{}:
+			index, err := strconv.Atoi(segment)
+			if err != nil || index < 0 || index >= len(v) {
+				return nil, false
+			}
+			value = v[index]
+		default:
+			return nil, false
+		}
+	}
+	return value, true
+}
+
+// withoutNulls returns a copy of value with null-valued object fields
+// removed at every depth. Null array elements are kept.
+func withoutNulls(value interface{}) interface{} {
+	switch v := value.(type) {
+	case map[string]interface{}:
+		stripped := make(map[string]interface{}, len(v))
+		for key, field := range v {
+			if field != nil {
+				stripped[key] = withoutNulls(field)
+			}
+		}
+		return stripped
+	case []interface{}:
+		stripped := make([]interface{}, len(v))
+		for i, element := range v {
+			stripped[i] = withoutNulls(element)
+		}
+		return stripped
+	}
+	return value
+}
+
+// withoutPath returns value with the object field at a dotted path like
+// "user.email" removed, copying only the objects and arrays along the path.
+// Numeric segments index into arrays. A path that doesn't exist leaves
+// value unchanged.
+func withoutPath(value interface{}, path string) interface{} {
+	return withoutSegments(value, strings.Split(path, "."))
+}
+
+func withoutSegments(value interface{}, segments []string) interface{} {
+	segment, rest := segments[0], segments[1:]
+	switch v := value.(type) {
+	case map[string]interface{}:
+		field, ok := v[segment]
+		if !ok {
+			return value
+		}
+		copied := make(map[string]interface{}, len(v))
+		for key, f := range v {
+			copied[key] = f
+		}
+		if len(rest) == 0 {
+			delete(copied, segment)
+		} else {
+			copied[segment] = withoutSegments(field, rest)
+		}
+		return copied
+	case []interface{}:
+		index, err := strconv.Atoi(segment)
+		if err != nil || index < 0 || index >= len(v) || len(rest) == 0 {
+			return value
+		}
+		copied := append([]interface{}{}, v...)
+		copied[index] = withoutSegments(v[index], rest)
+		return copied
+	}
+	return value
+}
+
+// sortedKeys returns the keys of an object in sorted order.
+func sortedKeys(object map[string]interface{}) []string {
+	keys := make([]string, 0, len(object))
+	for key := range object {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
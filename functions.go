@@ -0,0 +1,73 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/base64"
+	"fmt"
+
+	"github.com/expr-lang/expr"
+)
+
+// exprFunctions are the functions available to expressions in addition to
+// expr's builtins.
+var exprFunctions = []expr.Option{
+	expr.Function("has", has, new(func(interface{}, interface{}) bool)),
+	expr.Function("gzipb64", gzipb64, new(func(string) string)),
+}
+
+// has reports whether a map contains a key, or an array an index.
+func has(params ...interface{}) (interface{}, error) {
+	switch collection := params[0].(type) {
+	case nil:
+		return false, nil
+	case map[string]interface{}:
+		key, ok := params[1].(string)
+		if !ok {
+			return nil, fmt.Errorf("has: map key must be a string, not %T", params[1])
+		}
+		_, found := collection[key]
+		return found, nil
+	case []interface{}:
+		index, ok := toInt(params[1])
+		if !ok {
+			return nil, fmt.Errorf("has: array index must be an integer, not %T", params[1])
+		}
+		return index >= 0 && index < len(collection), nil
+	}
+	return nil, fmt.Errorf("has: expected a map or array, not %T", params[0])
+}
+
+// gzipb64 compresses a string with gzip at the default compression level
+// and returns it in standard, padded base64.
+func gzipb64(params ...interface{}) (interface{}, error) {
+	s, ok := params[0].(string)
+	if !ok {
+		return nil, fmt.Errorf("gzipb64: expected a string, not %T", params[0])
+	}
+
+	var buf bytes.Buffer
+	w := gzip.NewWriter(&buf)
+	if _, err := w.Write([]byte(s)); err != nil {
+		return nil, fmt.Errorf("gzipb64: %w", err)
+	}
+	if err := w.Close(); err != nil {
+		return nil, fmt.Errorf("gzipb64: %w", err)
+	}
+	return base64.StdEncoding.EncodeToString(buf.Bytes()), nil
+}
+
+// toInt converts an integral number to an int.
+func toInt(v interface{}) (int, bool) {
+	switch n := v.(type) {
+	case int:
+		return n, true
+	case int64:
+		return int(n), true
+	case float64:
+		if n == float64(int(n)) {
+			return int(n), true
+		}
+	}
+	return 0, false
+}
@@ -3,12 +3,17 @@ module github.com/octoberswimmer/pub
 go 1.21
 
 require (
+	github.com/andybalholm/brotli v1.1.1
 	github.com/expr-lang/expr v1.17.5
+	github.com/itchyny/gojq v0.12.17
 	github.com/joho/godotenv v1.5.1
 	github.com/spf13/cobra v1.8.1
+	github.com/spf13/pflag v1.0.5
+	golang.org/x/net v0.35.0
+	gopkg.in/yaml.v3 v3.0.1
 )
 
 require (
 	github.com/inconshreveable/mousetrap v1.1.0 // indirect
-	github.com/spf13/pflag v1.0.5 // indirect
+	github.com/itchyny/timefmt-go v0.1.6 // indirect
 )
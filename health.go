@@ -0,0 +1,48 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"time"
+)
+
+// checkHealth sends a GET request to url and returns an error unless the
+// response status is one of expect.
+func checkHealth(ctx context.Context, client *http.Client, url string, expect statusRanges) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return fmt.Errorf("creating request: %w", err)
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	io.Copy(io.Discard, resp.Body)
+
+	if !expect.contains(resp.StatusCode) {
+		return fmt.Errorf("%s returned %s", url, resp.Status)
+	}
+	return nil
+}
+
+// waitForHealthy polls url with checkHealth every interval until it's
+// healthy, giving up with the last error once timeout has passed.
+func waitForHealthy(ctx context.Context, client *http.Client, url string, expect statusRanges, interval, timeout time.Duration) error {
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	for {
+		err := checkHealth(ctx, client, url, expect)
+		if err == nil {
+			return nil
+		}
+		select {
+		case <-time.After(interval):
+		case <-ctx.Done():
+			return fmt.Errorf("%s not ready after %s: %w", url, timeout, err)
+		}
+	}
+}
@@ -0,0 +1,91 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"os/exec"
+	"strings"
+)
+
+// hookRequest is the request passed as JSON to a --pre-request command.
+type hookRequest struct {
+	Method  string              `json:"method"`
+	URL     string              `json:"url"`
+	Headers map[string][]string `json:"headers"`
+	Body    string              `json:"body"`
+	Input   interface{}         `json:"input"`
+}
+
+// hookResponse is the response passed as JSON to a --post-response
+// command.
+type hookResponse struct {
+	URL      string      `json:"url"`
+	Status   int         `json:"status"`
+	Response interface{} `json:"response"`
+	Input    interface{} `json:"input"`
+}
+
+// runPreRequest runs command with the request as JSON on its stdin, and
+// sets each "Name: value" line it writes to stdout as a header. The command
+// is killed if the request's context is cancelled, and a non-zero exit is
+// an error.
+func runPreRequest(command string, req *http.Request, body []byte, input interface{}) error {
+	data, err := json.Marshal(hookRequest{
+		Method:  req.Method,
+		URL:     req.URL.String(),
+		Headers: req.Header,
+		Body:    string(body),
+		Input:   input,
+	})
+	if err != nil {
+		return fmt.Errorf("pre-request: encoding request: %w", err)
+	}
+
+	cmd := exec.CommandContext(req.Context(), "sh", "-c", command)
+	cmd.Stdin = bytes.NewReader(data)
+	cmd.Stderr = os.Stderr
+	out, err := cmd.Output()
+	if err != nil {
+		return fmt.Errorf("pre-request: %w", err)
+	}
+
+	for _, line := range strings.Split(string(out), "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" {
+			continue
+		}
+		name, value, ok := strings.Cut(line, ":")
+		if !ok {
+			return fmt.Errorf("pre-request: invalid header %q", line)
+		}
+		setHeader(req.Header, strings.TrimSpace(name), strings.TrimSpace(value))
+	}
+	return nil
+}
+
+// runPostResponse runs command with the response as JSON on its stdin. Its
+// stdout goes to the output and its stderr is passed through, and a
+// non-zero exit is an error.
+func runPostResponse(command string, req *http.Request, resp *http.Response, body []byte, input interface{}) error {
+	data, err := json.Marshal(hookResponse{
+		URL:      req.URL.String(),
+		Status:   resp.StatusCode,
+		Response: parseResponseBody(body),
+		Input:    input,
+	})
+	if err != nil {
+		return fmt.Errorf("post-response: encoding response: %w", err)
+	}
+
+	cmd := exec.CommandContext(req.Context(), "sh", "-c", command)
+	cmd.Stdin = bytes.NewReader(data)
+	cmd.Stdout = output
+	cmd.Stderr = os.Stderr
+	if err := cmd.Run(); err != nil {
+		return fmt.Errorf("post-response: %w", err)
+	}
+	return nil
+}
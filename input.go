@@ -0,0 +1,207 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+)
+
+// inputFiles reads a sequence of files as one stream. Each file is opened
+// only once the previous one is exhausted, and is followed by separator, or
+// a newline if it's empty, so that a file without a trailing delimiter
+// doesn't run into the next.
+type inputFiles struct {
+	paths     []string
+	separator []byte
+	current   *os.File
+	pending   []byte
+
+	read   int64       // bytes read so far
+	starts []fileStart // where each opened file begins in the stream
+}
+
+// fileStart is the offset in a stream of inputFiles where a file begins.
+type fileStart struct {
+	offset int64
+	path   string
+}
+
+// inputPathsFor returns the files given with --input followed by those
+// matching --input-glob, in order.
+func inputPathsFor(files []string, pattern string) ([]string, error) {
+	paths := append([]string{}, files...)
+	if pattern != "" {
+		matches, err := filepath.Glob(pattern)
+		if err != nil {
+			return nil, fmt.Errorf("invalid input glob: %w", err)
+		}
+		if len(matches) == 0 {
+			return nil, fmt.Errorf("no files match input glob %s", pattern)
+		}
+		paths = append(paths, matches...)
+	}
+	return paths, nil
+}
+
+func (f *inputFiles) Read(p []byte) (int, error) {
+	for {
+		if len(f.pending) > 0 {
+			n := copy(p, f.pending)
+			f.pending = f.pending[n:]
+			f.read += int64(n)
+			return n, nil
+		}
+		if f.current == nil {
+			if len(f.paths) == 0 {
+				return 0, io.EOF
+			}
+			file, err := os.Open(f.paths[0])
+			if err != nil {
+				return 0, err
+			}
+			f.current = file
+			f.starts = append(f.starts, fileStart{offset: f.read, path: f.paths[0]})
+			f.paths = f.paths[1:]
+		}
+
+		n, err := f.current.Read(p)
+		f.read += int64(n)
+		if err == io.EOF {
+			f.current.Close()
+			f.current = nil
+			f.pending = f.separator
+			if len(f.pending) == 0 {
+				f.pending = []byte("\n")
+			}
+			if n == 0 {
+				continue
+			}
+			err = nil
+		}
+		return n, err
+	}
+}
+
+// pathAt returns the path of the file containing the byte at offset in
+// the stream.
+func (f *inputFiles) pathAt(offset int64) string {
+	path := ""
+	for _, start := range f.starts {
+		if start.offset > offset {
+			break
+		}
+		path = start.path
+	}
+	return path
+}
+
+// sourceTracker records which of files the last record scanned from them
+// came from, by counting the bytes the scanner consumes.
+type sourceTracker struct {
+	files   *inputFiles
+	split   bufio.SplitFunc
+	offset  int64
+	current string
+}
+
+// scan is a bufio.SplitFunc that splits records with t.split.
+func (t *sourceTracker) scan(data []byte, atEOF bool) (int, []byte, error) {
+	advance, token, err := t.split(data, atEOF)
+	if token != nil {
+		t.current = t.files.pathAt(t.offset)
+	}
+	t.offset += int64(advance)
+	return advance, token, err
+}
+
+// source returns the path of the file the last record came from.
+func (t *sourceTracker) source() string {
+	return t.current
+}
+
+// Close closes the file being read, if any.
+func (f *inputFiles) Close() error {
+	if f.current == nil {
+		return nil
+	}
+	return f.current.Close()
+}
+
+// readingStdin reports whether input is read from stdin rather than files.
+func readingStdin() bool {
+	return len(inputFilePaths) == 0 && inputGlob == "" && replayPath == ""
+}
+
+// parseDelimiter interprets the value of --input-delimiter, which may use Go
+// string escapes like \t or \x1e, and \0 for a NUL byte.
+func parseDelimiter(value string) ([]byte, error) {
+	if value == `\0` {
+		return []byte{0}, nil
+	}
+	delimiter, err := strconv.Unquote(`"` + value + `"`)
+	if err != nil {
+		return nil, fmt.Errorf("invalid input delimiter %q", value)
+	}
+	if delimiter == "" {
+		return nil, fmt.Errorf("input delimiter is empty")
+	}
+	return []byte(delimiter), nil
+}
+
+// splitOn returns a split function for bufio.Scanner that yields the
+// records separated by delimiter. A final record needn't be terminated.
+func splitOn(delimiter []byte) bufio.SplitFunc {
+	return func(data []byte, atEOF bool) (int, []byte, error) {
+		if i := bytes.Index(data, delimiter); i >= 0 {
+			return i + len(delimiter), data[:i], nil
+		}
+		if atEOF && len(data) > 0 {
+			return len(data), data, nil
+		}
+		return 0, nil, nil
+	}
+}
+
+// inputLimit caps the input read with --input-limit-bytes.
+type inputLimit struct {
+	reader  *io.LimitedReader
+	dropped int // bytes of the incomplete record cut off by the limit
+}
+
+// readLimit is the --input-limit-bytes limit on this run's input, if any.
+var readLimit *inputLimit
+
+// limitInput returns in limited to n bytes.
+func limitInput(in io.Reader, n int64) *inputLimit {
+	return &inputLimit{reader: &io.LimitedReader{R: in, N: n}}
+}
+
+func (l *inputLimit) Read(p []byte) (int, error) {
+	return l.reader.Read(p)
+}
+
+// reached reports whether all of the limit has been read.
+func (l *inputLimit) reached() bool {
+	return l != nil && l.reader.N <= 0
+}
+
+// split wraps split so that once the limit is reached, a final record
+// without its terminator, cut short by the limit rather than ended by the
+// input, is dropped instead of being sent.
+func (l *inputLimit) split(split bufio.SplitFunc) bufio.SplitFunc {
+	return func(data []byte, atEOF bool) (int, []byte, error) {
+		if !atEOF || !l.reached() {
+			return split(data, atEOF)
+		}
+		advance, token, err := split(data, false)
+		if token == nil && err == nil {
+			l.dropped += len(data)
+			return len(data), nil, nil
+		}
+		return advance, token, err
+	}
+}
@@ -0,0 +1,43 @@
+package main
+
+import (
+	"fmt"
+
+	"github.com/itchyny/gojq"
+)
+
+// jqProgram is a jq program used in place of an expr transform.
+type jqProgram struct {
+	code *gojq.Code
+}
+
+func compileJQ(program string) (*jqProgram, error) {
+	query, err := gojq.Parse(program)
+	if err != nil {
+		return nil, err
+	}
+	code, err := gojq.Compile(query)
+	if err != nil {
+		return nil, err
+	}
+	return &jqProgram{code: code}, nil
+}
+
+// evaluate runs the program against input. The program must produce
+// exactly one value.
+func (p *jqProgram) evaluate(input interface{}) (interface{}, error) {
+	iter := p.code.Run(input)
+
+	result, ok := iter.Next()
+	if !ok {
+		return nil, fmt.Errorf("jq program produced no output")
+	}
+	if err, isErr := result.(error); isErr {
+		return nil, err
+	}
+
+	if _, more := iter.Next(); more {
+		return nil, fmt.Errorf("jq program produced more than one output; wrap it in [...] to send an array")
+	}
+	return result, nil
+}
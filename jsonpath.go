@@ -0,0 +1,117 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// jsonPath is a compiled JSONPath expression supporting child fields
+// (.name or ['name']), array indexes ([0], with negative indexes counting
+// from the end), and wildcards (.* or [*]).
+type jsonPath struct {
+	segments []pathSegment
+}
+
+// pathSegment is one step of a jsonPath.
+type pathSegment struct {
+	field    string
+	index    int
+	isIndex  bool
+	wildcard bool
+}
+
+// compileJSONPath parses a JSONPath expression like $.records[*].
+func compileJSONPath(path string) (*jsonPath, error) {
+	rest, ok := strings.CutPrefix(strings.TrimSpace(path), "$")
+	if !ok {
+		return nil, fmt.Errorf("JSONPath must start with $")
+	}
+
+	p := &jsonPath{}
+	for rest != "" {
+		var segment pathSegment
+		switch {
+		case strings.HasPrefix(rest, ".."):
+			return nil, fmt.Errorf("recursive descent (..) is not supported")
+		case strings.HasPrefix(rest, ".*"):
+			segment.wildcard = true
+			rest = rest[2:]
+		case rest[0] == '.':
+			end := strings.IndexAny(rest[1:], ".[")
+			if end < 0 {
+				end = len(rest) - 1
+			}
+			segment.field = rest[1 : end+1]
+			if segment.field == "" {
+				return nil, fmt.Errorf("empty field name in %s", path)
+			}
+			rest = rest[end+1:]
+		case rest[0] == '[':
+			end := strings.IndexByte(rest, ']')
+			if end < 0 {
+				return nil, fmt.Errorf("unclosed [ in %s", path)
+			}
+			inner := strings.TrimSpace(rest[1:end])
+			rest = rest[end+1:]
+			if inner == "*" {
+				segment.wildcard = true
+			} else if len(inner) >= 2 && (inner[0] == '\'' || inner[0] == '"') && inner[len(inner)-1] == inner[0] {
+				segment.field = inner[1 : len(inner)-1]
+			} else if index, err := strconv.Atoi(inner); err == nil {
+				segment.index, segment.isIndex = index, true
+			} else {
+				return nil, fmt.Errorf("unsupported selector [%s] in %s", inner, path)
+			}
+		default:
+			return nil, fmt.Errorf("unexpected %q in %s", rest[0], path)
+		}
+		p.segments = append(p.segments, segment)
+	}
+	return p, nil
+}
+
+// selectFrom returns the values the path matches in v, in document order.
+// Object wildcards match in key order. Paths that lead nowhere match
+// nothing.
+func (p *jsonPath) selectFrom(v interface{}) []interface{} {
+	matches := []interface{}{v}
+	for _, segment := range p.segments {
+		var next []interface{}
+		for _, match := range matches {
+			next = append(next, segment.apply(match)...)
+		}
+		matches = next
+	}
+	return matches
+}
+
+func (s pathSegment) apply(v interface{}) []interface{} {
+	switch v := v.(type) {
+	case map[string]interface{}:
+		if s.wildcard {
+			var values []interface{}
+			for _, key := range sortedKeys(v) {
+				values = append(values, v[key])
+			}
+			return values
+		}
+		if value, ok := v[s.field]; ok && !s.isIndex {
+			return []interface{}{value}
+		}
+	case []interface{}:
+		if s.wildcard {
+			return v
+		}
+		if s.isIndex {
+			index := s.index
+			if index < 0 {
+				index += len(v)
+			}
+			if index >= 0 && index < len(v) {
+				return []interface{}{v[index]}
+			}
+		}
+	}
+	return nil
+}
@@ -3,24 +3,192 @@ package main
 import (
 	"bufio"
 	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/binary"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"io"
+	"math/big"
+	mathrand "math/rand"
 	"net/http"
 	"os"
+	"reflect"
+	"strconv"
 	"strings"
+	"sync"
+	"sync/atomic"
+	"text/template"
+	"time"
+	"unicode/utf8"
 
 	"github.com/expr-lang/expr"
+	"github.com/expr-lang/expr/ast"
+	"github.com/expr-lang/expr/types"
+	"github.com/expr-lang/expr/vm"
 	"github.com/joho/godotenv"
 	"github.com/spf13/cobra"
 )
 
 var (
-	headers       []string
-	transform     string
-	requestMethod string
-	dryRun        bool
+	headers             []string
+	transform           string
+	requestMethod       string
+	dryRun              bool
+	requestIDHeader     string
+	requestIDExpr       string
+	contentType         string
+	bodyString          bool
+	noContentType       bool
+	configFile          string
+	stopOnStatus        []string
+	reauthExpr          string
+	preflight           bool
+	strictEnv           bool
+	repeat              int
+	explode             bool
+	deadLetterPath      string
+	deadLetterOn        string
+	deadLetterFormat    string
+	rate                float64
+	ramp                time.Duration
+	transformFile       string
+	jqTransform         bool
+	streamBody          bool
+	onSuccess           string
+	outputFile          string
+	traceRequests       bool
+	explodeFields       bool
+	deadline            time.Duration
+	retries             int
+	retryDelay          time.Duration
+	retryBudgetSize     int
+	errorsOnly          bool
+	parseWorkers        int
+	socks5Proxy         string
+	tlsMinVersion       string
+	tlsMaxVersion       string
+	rawHeaders          bool
+	bodyField           string
+	maxBodyLogBytes     int
+	defaultBody         string
+	validateJSON        string
+	outputTemplate      string
+	countOnly           bool
+	inputFilePaths      []string
+	inputGlob           string
+	stripNulls          bool
+	lineTimeout         time.Duration
+	confirm             bool
+	assumeYes           bool
+	tee                 bool
+	drainStdin          bool
+	tokenFilePath       string
+	maxRequests         int64
+	preserveAuthHosts   []string
+	jsonNumbers         bool
+	healthURL           string
+	healthExpectStatus  []string
+	errorExitCode       int
+	preRequest          string
+	postResponse        string
+	postResponseStrict  bool
+	dnsServer           string
+	templateBody        string
+	maxParseErrors      int
+	inputJSONPath       string
+	replayPath          string
+	requestTimeout      time.Duration
+	timeoutPerKB        time.Duration
+	summaryJSON         string
+	redactHeaders       []string
+	retryIdempotentOnly bool
+	printEnv            bool
+	maxConnections      int
+	inputDelimiter      string
+	frameLengthPrefix   bool
+	retryAfterMax       time.Duration
+	idleTimeout         time.Duration
+	bootstrapURL        string
+	bootstrapExpr       string
+	bootstrapHeaders    []string
+	dropFields          []string
+	methodExpr          string
+	methodMap           map[string]string
+	tlsServerName       string
+	auditPath           string
+	waitForURL          string
+	waitInterval        time.Duration
+	waitTimeout         time.Duration
+	metaField           string
+	flushEvery          int
+	flushInterval       time.Duration
+	shuffle             bool
+	shuffleSeed         int64
+	requirements        []string
+	checkpointPath      string
+	checkpointEvery     int64
+	resume              bool
+	carryHeaders        []string
+	maxMemory           string
+	certFile            string
+	keyFile             string
+	certHosts           []string
+	inputLimitBytes     string
+	statusExpr          string
+	adaptiveRate        bool
+	rateDecrease        float64
+	rateIncrease        float64
+	confirmAfter        int
+	http1Only           bool
+	varsFile            string
+	compactOutput       bool
+	histogram           bool
 )
 
+// limiter paces requests when --rate is set.
+var limiter *rateLimiter
+
+// awaitingConfirmation is set with --confirm until the first request has
+// been approved.
+var awaitingConfirmation bool
+
+// previousResponse is the parsed body of the last successful response,
+// exposed to expressions as prev.
+var previousResponse interface{}
+
+// lineStateMu guards previousResponse and carried. They're only changed by
+// publishResult, once a line has finished in time, but a line abandoned by
+// --line-timeout may still be reading them.
+var lineStateMu sync.Mutex
+
+// publishResult updates what later lines see of a finished line: its
+// response becomes prev if it succeeded, and its carried headers are
+// remembered.
+func publishResult(result lineResult) {
+	lineStateMu.Lock()
+	defer lineStateMu.Unlock()
+	if result.succeeded {
+		previousResponse = parseResponseBody(result.response)
+	}
+	for name, value := range result.carried {
+		carried[name] = value
+	}
+}
+
+// lastResponse returns prev for a new line.
+func lastResponse() interface{} {
+	lineStateMu.Lock()
+	defer lineStateMu.Unlock()
+	return previousResponse
+}
+
+// output receives the per-line results. It's unbuffered, and each result
+// is written with a single write, so consumers tailing it see every line as
+// soon as it's complete.
+var output io.Writer = os.Stdout
+
 var rootCmd = &cobra.Command{
 	Use:   "pub <URL expression>",
 	Short: "Read JSON from stdin, transform it, and send HTTP requests",
@@ -29,20 +197,199 @@ and sends HTTP requests to the specified URL.
 
 Example:
   force pubsub subscribe /event/Fax_Classification_Job_Update__e | pub --transform '{data: input}' --header '"Authorization: Bearer " + env.EVENTS_PUBLISH_TOKEN' --request POST '"http://localhost:8080/publish?queue=" + input.eFax_Test_Queue'`,
-	Args: cobra.ExactArgs(1),
-	Run:  run,
+	Args: func(cmd *cobra.Command, args []string) error {
+		if printEnv {
+			return cobra.MaximumNArgs(1)(cmd, args)
+		}
+		return cobra.ExactArgs(1)(cmd, args)
+	},
+	PreRunE: loadConfig,
+	Run:     run,
+}
+
+var completionCmd = &cobra.Command{
+	Use:   "completion [bash|zsh|fish|powershell]",
+	Short: "Generate a shell completion script",
+	Long: `Generate a shell completion script for pub.
+
+To load completions in the current bash session:
+  source <(pub completion bash)`,
+	ValidArgs:             []string{"bash", "zsh", "fish", "powershell"},
+	Args:                  cobra.MatchAll(cobra.ExactArgs(1), cobra.OnlyValidArgs),
+	DisableFlagsInUseLine: true,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		switch args[0] {
+		case "bash":
+			return rootCmd.GenBashCompletionV2(os.Stdout, true)
+		case "zsh":
+			return rootCmd.GenZshCompletion(os.Stdout)
+		case "fish":
+			return rootCmd.GenFishCompletion(os.Stdout, true)
+		case "powershell":
+			return rootCmd.GenPowerShellCompletionWithDesc(os.Stdout)
+		}
+		return nil
+	},
 }
 
 func init() {
 	rootCmd.Flags().StringArrayVar(&headers, "header", []string{}, "Add header (can be used multiple times)")
 	rootCmd.Flags().StringVar(&transform, "transform", "", "Transform expression to apply to input")
+	rootCmd.Flags().BoolVar(&rawHeaders, "raw-headers", false, "Send header names exactly as given instead of canonicalizing them")
+	rootCmd.Flags().StringVar(&templateBody, "template-body", "", "Render the body from a Go template with .Input and .Env, instead of a transform")
+	rootCmd.Flags().StringVar(&bodyField, "body-field", "", "Send the field at this dotted path of the input as the body")
+	rootCmd.Flags().StringVar(&defaultBody, "default-body", "input", "Body to send without a transform: input, empty, or none")
+	rootCmd.Flags().StringVar(&transformFile, "transform-file", "", "Read the transform expression from a file")
+	rootCmd.Flags().BoolVar(&jqTransform, "jq", false, "Interpret the transform as a jq program instead of an expr expression")
 	rootCmd.Flags().StringVar(&requestMethod, "request", "POST", "HTTP request method")
+	rootCmd.Flags().StringVar(&methodExpr, "method-expr", "", "Expression giving each line's HTTP method, instead of --request")
+	rootCmd.Flags().StringToStringVar(&methodMap, "method-map", nil, "Map --method-expr results to methods, like CREATE=POST,DELETE=DELETE")
 	rootCmd.Flags().BoolVar(&dryRun, "dry-run", false, "Print requests without sending them")
+	rootCmd.Flags().BoolVar(&confirm, "confirm", false, "Show the first request and ask before sending it")
+	rootCmd.Flags().IntVar(&confirmAfter, "confirm-after", 0, "Send this many requests, then show how they went and ask before sending the rest")
+	rootCmd.Flags().BoolVar(&assumeYes, "yes", false, "Answer yes to the --confirm and --confirm-after prompts")
+	rootCmd.Flags().BoolVar(&countOnly, "count-only", false, "Evaluate every line without sending, then print how many requests would be sent")
+	rootCmd.Flags().StringSliceVar(&redactHeaders, "redact-headers", nil, "Headers, or glob patterns like *-Token, to redact in printed requests and responses, in addition to Authorization and cookies")
+	rootCmd.Flags().BoolVar(&printEnv, "print-env", false, "Print the names of the variables available as env and the dotenv files loaded, then exit if no URL is given")
+	rootCmd.Flags().StringArrayVar(&carryHeaders, "carry-header", nil, "Copy this response header onto the next request, or RESPONSE=REQUEST to rename it, like ETag=If-Match (can be used multiple times)")
+	rootCmd.Flags().StringVar(&requestIDHeader, "request-id-header", "", "Header to carry a unique request ID generated for each line")
+	rootCmd.Flags().StringVar(&contentType, "content-type", "application/json", "Content-Type header to send with each request")
+	rootCmd.Flags().BoolVar(&noContentType, "no-default-content-type", false, "Don't send a Content-Type header unless one is given with --header")
+	rootCmd.Flags().BoolVar(&frameLengthPrefix, "frame-length-prefix", false, "Prefix the body with its length as a 4-byte big-endian integer")
+	rootCmd.Flags().BoolVar(&streamBody, "stream-body", false, "Stream the JSON body into the request instead of buffering it")
+	rootCmd.Flags().BoolVar(&bodyString, "body-string", false, "Send string bodies verbatim instead of JSON encoding them")
+	rootCmd.Flags().StringVar(&requestIDExpr, "request-id-expr", "", "Expression to derive the request ID from input instead of generating one")
+	rootCmd.Flags().StringSliceVar(&stopOnStatus, "stop-on-status", []string{}, "Stop processing and exit when a response has one of these statuses (e.g. 401,402,500-599)")
+	rootCmd.Flags().StringVar(&preRequest, "pre-request", "", "Shell command to run before each request, given the request as JSON; lines it prints are added as headers")
+	rootCmd.Flags().StringVar(&postResponse, "post-response", "", "Shell command to run after each response, given the status, response, and input as JSON")
+	rootCmd.Flags().BoolVar(&postResponseStrict, "post-response-strict", false, "Fail the line if the --post-response command exits non-zero")
+	rootCmd.Flags().StringVar(&tokenFilePath, "token-file", "", "Send the token in this file as a bearer token, re-reading it when it changes")
+	rootCmd.Flags().StringVar(&reauthExpr, "reauth-expr", "", "Expression evaluated against a 401 response to get a new Authorization header value for one retry")
+	rootCmd.Flags().StringVar(&healthURL, "health-url", "", "Check that this URL is healthy before reading any input, exiting non-zero if not")
+	rootCmd.Flags().StringVar(&varsFile, "vars-file", "", "Load variables from a JSON or YAML file, exposed to expressions as vars")
+	rootCmd.Flags().StringVar(&bootstrapURL, "bootstrap-url", "", "Fetch this URL once before reading any input, exposing the response to expressions as bootstrap")
+	rootCmd.Flags().StringVar(&bootstrapExpr, "bootstrap-expr", "", "Expression of response and status giving the value of bootstrap, instead of the whole response")
+	rootCmd.Flags().StringArrayVar(&bootstrapHeaders, "bootstrap-header", nil, "Header expression for the --bootstrap-url request, evaluated with only env (can be used multiple times)")
+	rootCmd.Flags().StringVar(&waitForURL, "wait-for", "", "Poll this URL until it's healthy before reading any input, exiting non-zero if it isn't within --wait-timeout")
+	rootCmd.Flags().DurationVar(&waitInterval, "wait-interval", time.Second, "Time between --wait-for polls")
+	rootCmd.Flags().DurationVar(&waitTimeout, "wait-timeout", time.Minute, "How long to wait for --wait-for to become healthy")
+	rootCmd.Flags().StringSliceVar(&healthExpectStatus, "health-expect-status", []string{"200-299"}, "Statuses from --health-url that count as healthy, e.g. 200 or 200-299")
+	rootCmd.Flags().BoolVar(&preflight, "preflight", false, "Send a single request for the first input line, print the full response, and exit")
+	rootCmd.Flags().BoolVar(&strictEnv, "strict-env", false, "Fail if an expression references an environment variable that isn't set")
+	rootCmd.Flags().IntVar(&repeat, "repeat", 1, "Send the request for each input line this many times")
+	rootCmd.Flags().BoolVar(&explode, "explode", false, "Send a separate request for each element of an input line that is a JSON array")
+	rootCmd.Flags().StringVar(&inputJSONPath, "input-jsonpath", "", "Send each record selected from an input line by this JSONPath, like $.records[*]")
+	rootCmd.Flags().BoolVar(&explodeFields, "explode-fields", false, "Send a separate request for each top-level field of an input object, exposed as key and value")
+	rootCmd.Flags().StringVar(&deadLetterPath, "dead-letter-file", "", "Append failed lines to this file")
+	rootCmd.Flags().StringVar(&deadLetterOn, "dead-letter-on", "", "Only dead-letter responses with these statuses (e.g. 400-499) or matching this expression")
+	rootCmd.Flags().Float64Var(&rate, "rate", 0, "Maximum requests per second (0 for no limit)")
+	rootCmd.Flags().BoolVar(&adaptiveRate, "adaptive-rate", false, "Start at --rate, slow down on 429 and 503 responses, and speed back up to --rate while requests succeed")
+	rootCmd.Flags().Float64Var(&rateDecrease, "rate-decrease", 0.5, "With --adaptive-rate, multiply the rate by this on a 429 or 503")
+	rootCmd.Flags().Float64Var(&rateIncrease, "rate-increase", 1, "With --adaptive-rate, requests per second to add for each second of successful requests")
+	rootCmd.Flags().DurationVar(&ramp, "ramp", 0, "Ramp the request rate up linearly to --rate over this duration")
+	rootCmd.Flags().StringVar(&statusExpr, "status-expr", "", "Expression deciding each response's outcome instead of its HTTP status: a boolean, or a string that is \"ok\" for success")
+	rootCmd.Flags().StringVar(&onSuccess, "on-success", "", "Expression evaluated after each successful request whose result is written to the output")
+	rootCmd.Flags().IntVar(&maxParseErrors, "max-parse-errors", 0, "Stop and exit non-zero once more than this many lines aren't valid JSON (0 for no limit)")
+	rootCmd.Flags().IntVar(&errorExitCode, "error-exit-code", 0, "Exit with this status if any line failed (0 to exit successfully regardless)")
+	rootCmd.Flags().BoolVar(&histogram, "histogram", false, "Instead of a line per request, print how many responses had each status code, and how many lines failed in each way, at the end")
+	rootCmd.Flags().BoolVar(&errorsOnly, "errors-only", false, "Only output lines that failed, with their input")
+	rootCmd.Flags().IntVar(&flushEvery, "flush-every", 1, "Write dead letters and audit records to their files in batches of this many")
+	rootCmd.Flags().DurationVar(&flushInterval, "flush-interval", 0, "With --flush-every, also write batched records at least this often")
+	rootCmd.Flags().StringVar(&auditPath, "audit-file", "", "Append a JSON record of each request sent and its response to this file")
+	rootCmd.Flags().StringVar(&outputFile, "output-file", "", "Write per-line results to this file instead of stdout")
+	rootCmd.Flags().BoolVar(&tee, "tee", false, "With --output-file, write results to stdout as well as the file")
+	rootCmd.Flags().StringVar(&deadLetterFormat, "dead-letter-format", "raw", "Dead-letter record format: raw (the original line), json, or an expression")
+	rootCmd.Flags().StringVar(&summaryJSON, "summary-json", "", "Write a JSON summary of the run to this file, or to stderr with -")
+	rootCmd.Flags().BoolVar(&traceRequests, "trace", false, "Log the DNS, connect, TLS, and server timing of each request to stderr")
+	rootCmd.Flags().BoolVar(&drainStdin, "drain-stdin", false, "After stopping early, read and discard the rest of stdin before exiting")
+	rootCmd.Flags().DurationVar(&requestTimeout, "timeout", 0, "Time out each request attempt after this long (0 for no timeout)")
+	rootCmd.Flags().DurationVar(&timeoutPerKB, "timeout-per-kb", 0, "Extend --timeout by this much for each KiB of request body")
+	rootCmd.Flags().DurationVar(&lineTimeout, "line-timeout", 0, "Give up on a line, including evaluating its expressions, after this long")
+	rootCmd.Flags().DurationVar(&idleTimeout, "idle-timeout", 0, "Stop cleanly once no input has arrived for this long")
+	rootCmd.Flags().DurationVar(&deadline, "deadline", 0, "Stop processing and cancel in-flight requests after this long, exiting non-zero")
+	rootCmd.Flags().Int64Var(&maxRequests, "max-requests", 0, "Stop once this many requests, including retries, have been sent (0 for no limit)")
+	rootCmd.Flags().IntVar(&maxConnections, "max-connections", 0, "Maximum number of connections open at once across all hosts (0 for no limit)")
+	rootCmd.Flags().IntVar(&retries, "retries", 0, "Retry transport errors, 429s, and 5xx responses up to this many times")
+	rootCmd.Flags().DurationVar(&retryDelay, "retry-delay", time.Second, "Delay before the first retry, doubling for each retry after")
+	rootCmd.Flags().DurationVar(&retryAfterMax, "retry-after-max", time.Minute, "Longest Retry-After delay to honor; longer ones fall back to the usual backoff")
+	rootCmd.Flags().BoolVar(&retryIdempotentOnly, "retry-idempotent-only", false, "Only retry requests with an idempotent method or an Idempotency-Key header")
+	rootCmd.Flags().IntVar(&retryBudgetSize, "retry-budget", 0, "Maximum retries across the whole run (0 for no limit)")
+	rootCmd.Flags().IntVar(&parseWorkers, "parse-workers", 1, "Number of goroutines parsing input lines ahead of sending")
+	rootCmd.Flags().StringSliceVar(&preserveAuthHosts, "preserve-auth-host", nil, "Keep the Authorization header when redirected to this host (can be used multiple times)")
+	rootCmd.Flags().StringVar(&dnsServer, "dns-server", "", "Resolve hostnames with the DNS server at host:port instead of the system resolver")
+	rootCmd.Flags().StringVar(&socks5Proxy, "socks5", "", "Send requests through a SOCKS5 proxy at host:port or user:pass@host:port")
+	rootCmd.Flags().StringVar(&tlsMinVersion, "tls-min-version", "", "Minimum TLS version: 1.0, 1.1, 1.2, or 1.3")
+	rootCmd.Flags().StringVar(&tlsMaxVersion, "tls-max-version", "", "Maximum TLS version: 1.0, 1.1, 1.2, or 1.3")
+	rootCmd.Flags().BoolVar(&http1Only, "http1-only", false, "Use HTTP/1.1 even with servers that support HTTP/2")
+	rootCmd.Flags().StringVar(&certFile, "cert", "", "Client certificate file for mutual TLS, used for hosts without a --cert-host")
+	rootCmd.Flags().StringVar(&keyFile, "key", "", "Private key file for --cert")
+	rootCmd.Flags().StringArrayVar(&certHosts, "cert-host", nil, "Client certificate for one host, as host=cert.pem,key.pem (can be used multiple times)")
+	rootCmd.Flags().StringVar(&tlsServerName, "tls-servername", "", "Server name to send with SNI and verify the certificate against, instead of the URL's host")
+	rootCmd.Flags().BoolVar(&compactOutput, "compact-output", false, "Print JSON responses on one line, without the server's indentation")
+	rootCmd.Flags().IntVar(&maxBodyLogBytes, "max-body-log-bytes", 0, "Truncate printed responses to this many bytes (0 for no limit)")
+	rootCmd.Flags().BoolVar(&jsonNumbers, "json-number", false, "Parse integers in the input exactly instead of as floating point")
+	rootCmd.Flags().StringVar(&metaField, "meta-field", "", "Expose the field at this dotted path of the input to expressions as meta")
+	rootCmd.Flags().StringArrayVar(&requirements, "require", nil, "Expression that must be true for a line to be sent, like 'type(input.items) == \"array\"' (can be used multiple times)")
+	rootCmd.Flags().StringArrayVar(&dropFields, "drop-field", nil, "Remove the field at this dotted path from the body (can be used multiple times)")
+	rootCmd.Flags().BoolVar(&stripNulls, "strip-nulls", false, "Remove null-valued fields from the body at every depth")
+	rootCmd.Flags().StringVar(&validateJSON, "validate-json", "", "Fail lines whose body isn't JSON of this type: object, array, or any")
+	rootCmd.Flags().StringVar(&outputTemplate, "output-template", "", "Go template for the line printed for each response")
+	rootCmd.Flags().StringArrayVar(&inputFilePaths, "input", nil, "Read input from this file instead of stdin (can be used multiple times)")
+	rootCmd.Flags().StringVar(&replayPath, "replay", "", "Read input from a dead-letter file written by pub, resending the original lines")
+	rootCmd.Flags().StringVar(&inputGlob, "input-glob", "", "Read input from the files matching this glob, in sorted order")
+	rootCmd.Flags().StringVar(&checkpointPath, "checkpoint-file", "", "Save the number of input lines finished to this file as the run goes")
+	rootCmd.Flags().Int64Var(&checkpointEvery, "checkpoint-every", 100, "Lines between checkpoint saves")
+	rootCmd.Flags().BoolVar(&resume, "resume", false, "Skip the input lines already finished according to --checkpoint-file")
+	rootCmd.Flags().BoolVar(&shuffle, "shuffle", false, "Read all of the input, then send it in random order")
+	rootCmd.Flags().StringVar(&inputLimitBytes, "input-limit-bytes", "", "Stop reading input after this many bytes, like 100MB")
+	rootCmd.Flags().StringVar(&maxMemory, "max-memory", "", "Most input, like 512MB, to hold in memory for --shuffle before giving up")
+	rootCmd.Flags().Int64Var(&shuffleSeed, "seed", 0, "Seed for --shuffle, to repeat the same order")
+	rootCmd.Flags().StringVar(&inputDelimiter, "input-delimiter", "", "Separate input records with this string instead of newlines, like \\0 for NUL")
+	rootCmd.Flags().StringVar(&configFile, "config", "", "Config file of flag defaults (default ~/"+defaultConfigFile+")")
+	rootCmd.MarkFlagsRequiredTogether("cert", "key")
+	rootCmd.MarkFlagsMutuallyExclusive("content-type", "no-default-content-type")
+	rootCmd.MarkFlagsMutuallyExclusive("count-only", "dry-run", "preflight")
+	rootCmd.MarkFlagsMutuallyExclusive("replay", "input")
+	rootCmd.MarkFlagsMutuallyExclusive("replay", "input-glob")
+	rootCmd.MarkFlagsMutuallyExclusive("replay", "input-delimiter")
+	rootCmd.MarkFlagsMutuallyExclusive("stream-body", "frame-length-prefix")
+	rootCmd.MarkFlagsMutuallyExclusive("request", "method-expr")
+	rootCmd.MarkFlagsMutuallyExclusive("checkpoint-file", "shuffle")
+	rootCmd.MarkFlagsMutuallyExclusive("transform", "transform-file", "body-field", "template-body")
+	rootCmd.MarkFlagsMutuallyExclusive("on-success", "errors-only", "output-template", "histogram")
+
+	rootCmd.RegisterFlagCompletionFunc("request", fixedCompletions(
+		http.MethodGet, http.MethodHead, http.MethodPost, http.MethodPut,
+		http.MethodPatch, http.MethodDelete, http.MethodOptions,
+	))
+	rootCmd.RegisterFlagCompletionFunc("default-body", fixedCompletions("input", "empty", "none"))
+	rootCmd.RegisterFlagCompletionFunc("validate-json", fixedCompletions("object", "array", "any"))
+	rootCmd.RegisterFlagCompletionFunc("dead-letter-format", fixedCompletions("raw", "json"))
+	rootCmd.RegisterFlagCompletionFunc("tls-min-version", fixedCompletions("1.0", "1.1", "1.2", "1.3"))
+	rootCmd.RegisterFlagCompletionFunc("tls-max-version", fixedCompletions("1.0", "1.1", "1.2", "1.3"))
+	rootCmd.RegisterFlagCompletionFunc("content-type", fixedCompletions(
+		"application/json", "application/x-ndjson", "application/x-www-form-urlencoded", "text/plain",
+	))
+	rootCmd.ValidArgsFunction = func(cmd *cobra.Command, args []string, toComplete string) ([]string, cobra.ShellCompDirective) {
+		return nil, cobra.ShellCompDirectiveNoFileComp
+	}
+	rootCmd.CompletionOptions.DisableDefaultCmd = true
+	rootCmd.AddCommand(completionCmd)
+}
+
+// fixedCompletions returns a flag completion function offering a fixed set
+// of values.
+func fixedCompletions(values ...string) func(*cobra.Command, []string, string) ([]string, cobra.ShellCompDirective) {
+	return func(cmd *cobra.Command, args []string, toComplete string) ([]string, cobra.ShellCompDirective) {
+		return values, cobra.ShellCompDirectiveNoFileComp
+	}
 }
 
 func main() {
 	// Load .env file if it exists
-	_ = godotenv.Load()
+	if godotenv.Load() == nil {
+		dotenvFiles = append(dotenvFiles, ".env")
+	}
 
 	if err := rootCmd.Execute(); err != nil {
 		os.Exit(1)
@@ -50,146 +397,2066 @@ func main() {
 }
 
 func run(cmd *cobra.Command, args []string) {
+	if printEnv {
+		printEnvironment(os.Stderr)
+		if len(args) == 0 {
+			return
+		}
+	}
 	urlExpr := args[0]
 
-	scanner := bufio.NewScanner(os.Stdin)
-	client := &http.Client{}
+	if requestIDExpr != "" && requestIDHeader == "" {
+		fmt.Fprintf(os.Stderr, "Error: --request-id-expr requires --request-id-header\n")
+		os.Exit(1)
+	}
 
-	for scanner.Scan() {
-		line := scanner.Text()
-		if strings.TrimSpace(line) == "" {
-			continue
-		}
+	if resume && checkpointPath == "" {
+		fmt.Fprintf(os.Stderr, "Error: --resume requires --checkpoint-file\n")
+		os.Exit(1)
+	}
+	if checkpointEvery < 1 {
+		fmt.Fprintf(os.Stderr, "Error: --checkpoint-every must be at least 1\n")
+		os.Exit(1)
+	}
 
-		if err := processLine(line, urlExpr, client); err != nil {
-			fmt.Fprintf(os.Stderr, "Error processing line: %v\n", err)
-			continue
+	var memoryLimit int64
+	if maxMemory != "" {
+		var err error
+		memoryLimit, err = parseByteSize(maxMemory)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error: --max-memory: %v\n", err)
+			os.Exit(1)
 		}
 	}
 
-	if err := scanner.Err(); err != nil {
-		fmt.Fprintf(os.Stderr, "Error reading stdin: %v\n", err)
+	if cmd.Flags().Changed("seed") && !shuffle {
+		fmt.Fprintf(os.Stderr, "Error: --seed requires --shuffle\n")
 		os.Exit(1)
 	}
-}
 
-func processLine(line string, urlExpr string, client *http.Client) error {
-	var input interface{}
-	if err := json.Unmarshal([]byte(line), &input); err != nil {
-		return fmt.Errorf("parsing JSON: %w", err)
+	if len(methodMap) > 0 && methodExpr == "" {
+		fmt.Fprintf(os.Stderr, "Error: --method-map requires --method-expr\n")
+		os.Exit(1)
+	}
+	for value, method := range methodMap {
+		normalized, err := normalizeMethod(method)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error: --method-map: %v\n", err)
+			os.Exit(1)
+		}
+		methodMap[value] = normalized
 	}
 
-	env := map[string]interface{}{
-		"input": input,
-		"env":   getEnvMap(),
+	if (bootstrapExpr != "" || len(bootstrapHeaders) > 0) && bootstrapURL == "" {
+		fmt.Fprintf(os.Stderr, "Error: --bootstrap-expr and --bootstrap-header require --bootstrap-url\n")
+		os.Exit(1)
 	}
 
-	// Evaluate URL expression or use as-is if not a valid expression
-	var urlStr string
-	urlResult, err := evaluateExpression(urlExpr, env)
+	method, err := normalizeMethod(requestMethod)
 	if err != nil {
-		// If evaluation fails, use the URL as a plain string
-		urlStr = urlExpr
-	} else {
-		// Convert the result to string
-		urlStr = fmt.Sprintf("%v", urlResult)
+		fmt.Fprintf(os.Stderr, "Error: --request: %v\n", err)
+		os.Exit(1)
 	}
+	requestMethod = method
 
-	// Transform input if specified
-	var body interface{}
-	if transform != "" {
-		body, err = evaluateExpression(transform, env)
+	if confirmAfter < 0 {
+		fmt.Fprintf(os.Stderr, "Error: --confirm-after must not be negative\n")
+		os.Exit(1)
+	}
+	if histogram && (dryRun || countOnly || preflight) {
+		fmt.Fprintf(os.Stderr, "Error: --histogram can't be used with --dry-run, --count-only, or --preflight\n")
+		os.Exit(1)
+	}
+	if countOnly && (waitForURL != "" || healthURL != "" || bootstrapURL != "") {
+		fmt.Fprintf(os.Stderr, "Error: --wait-for, --health-url, and --bootstrap-url can't be used with --count-only, which makes no requests\n")
+		os.Exit(1)
+	}
+	if confirmAfter > 0 && (dryRun || countOnly || preflight) {
+		fmt.Fprintf(os.Stderr, "Error: --confirm-after can't be used with --dry-run, --count-only, or --preflight\n")
+		os.Exit(1)
+	}
+	if confirmAfter > 0 && !assumeYes {
+		if err := checkTerminal("--confirm-after"); err != nil {
+			fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+			os.Exit(1)
+		}
+	}
+
+	// --count-only builds each request as --dry-run does, but only counts
+	// them
+	if countOnly {
+		dryRun = true
+	}
+
+	awaitingConfirmation = confirm && !assumeYes && !dryRun
+	if varsFile != "" {
+		vars, err := loadVars(varsFile)
 		if err != nil {
-			return fmt.Errorf("evaluating transform expression: %w", err)
+			fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+			os.Exit(1)
 		}
-	} else {
-		body = input
+		varsValue = vars
+	}
+	if tokenFilePath != "" {
+		bearerToken = &tokenFile{path: tokenFilePath}
 	}
 
-	// Marshal body to JSON
-	bodyBytes, err := json.Marshal(body)
-	if err != nil {
-		return fmt.Errorf("marshaling body: %w", err)
+	if repeat < 1 {
+		fmt.Fprintf(os.Stderr, "Error: --repeat must be at least 1\n")
+		os.Exit(1)
+	}
+	if parseWorkers < 1 {
+		fmt.Fprintf(os.Stderr, "Error: --parse-workers must be at least 1\n")
+		os.Exit(1)
+	}
+	if defaultBody != "input" && defaultBody != "empty" && defaultBody != "none" {
+		fmt.Fprintf(os.Stderr, "Error: --default-body must be one of input, empty, or none\n")
+		os.Exit(1)
+	}
+	if validateJSON != "" && validateJSON != "object" && validateJSON != "array" && validateJSON != "any" {
+		fmt.Fprintf(os.Stderr, "Error: --validate-json must be one of object, array, or any\n")
+		os.Exit(1)
+	}
+	if timeoutPerKB > 0 && requestTimeout <= 0 {
+		fmt.Fprintf(os.Stderr, "Error: --timeout-per-kb requires --timeout\n")
+		os.Exit(1)
+	}
+	if maxParseErrors < 0 {
+		fmt.Fprintf(os.Stderr, "Error: --max-parse-errors must not be negative\n")
+		os.Exit(1)
+	}
+	if errorExitCode < 0 || errorExitCode > 125 {
+		fmt.Fprintf(os.Stderr, "Error: --error-exit-code must be between 0 and 125\n")
+		os.Exit(1)
+	}
+	if maxRequests < 0 {
+		fmt.Fprintf(os.Stderr, "Error: --max-requests must not be negative\n")
+		os.Exit(1)
+	}
+	if waitInterval <= 0 || waitTimeout <= 0 {
+		fmt.Fprintf(os.Stderr, "Error: --wait-interval and --wait-timeout must be positive\n")
+		os.Exit(1)
+	}
+	if flushEvery < 1 || flushInterval < 0 {
+		fmt.Fprintf(os.Stderr, "Error: --flush-every must be at least 1 and --flush-interval must not be negative\n")
+		os.Exit(1)
+	}
+	if maxConnections < 0 {
+		fmt.Fprintf(os.Stderr, "Error: --max-connections must not be negative\n")
+		os.Exit(1)
+	}
+	if maxBodyLogBytes < 0 {
+		fmt.Fprintf(os.Stderr, "Error: --max-body-log-bytes must not be negative\n")
+		os.Exit(1)
 	}
 
-	// Create HTTP request
-	req, err := http.NewRequest(requestMethod, urlStr, bytes.NewReader(bodyBytes))
+	if transformFile != "" {
+		data, err := os.ReadFile(transformFile)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error reading transform file: %v\n", err)
+			os.Exit(1)
+		}
+		// Only the trailing newline and whitespace editors leave are
+		// trimmed; the rest of the file is used as written
+		transform = strings.TrimRight(string(data), " \t\r\n")
+		if transform == "" {
+			fmt.Fprintf(os.Stderr, "Error: transform file %s is empty\n", transformFile)
+			os.Exit(1)
+		}
+	}
+
+	exprs, err := compileExpressions(urlExpr)
 	if err != nil {
-		return fmt.Errorf("creating request: %w", err)
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		os.Exit(1)
+	}
+
+	var deadLetters *deadLetterFile
+	if deadLetterPath != "" {
+		deadLetters, err = compileDeadLetters(deadLetterOn, deadLetterFormat)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+			os.Exit(1)
+		}
 	}
 
-	req.Header.Set("Content-Type", "application/json")
+	if strictEnv {
+		if missing := exprs.missingEnv(getEnvMap(), deadLetters.expressions()...); len(missing) > 0 {
+			fmt.Fprintf(os.Stderr, "Error: environment variables not set: %s\n", strings.Join(missing, ", "))
+			os.Exit(1)
+		}
+	}
 
-	// Add headers
-	for _, header := range headers {
-		headerValue, err := evaluateExpression(header, env)
+	if retries < 0 || retryBudgetSize < 0 {
+		fmt.Fprintf(os.Stderr, "Error: --retries and --retry-budget must not be negative\n")
+		os.Exit(1)
+	}
+	if retryBudgetSize > 0 {
+		budget = &retryBudget{limit: int64(retryBudgetSize)}
+	}
+
+	if rate < 0 {
+		fmt.Fprintf(os.Stderr, "Error: --rate must not be negative\n")
+		os.Exit(1)
+	}
+	if ramp > 0 && rate == 0 {
+		fmt.Fprintf(os.Stderr, "Error: --ramp requires --rate\n")
+		os.Exit(1)
+	}
+	if adaptiveRate && rate == 0 {
+		fmt.Fprintf(os.Stderr, "Error: --adaptive-rate requires --rate\n")
+		os.Exit(1)
+	}
+	if (cmd.Flags().Changed("rate-decrease") || cmd.Flags().Changed("rate-increase")) && !adaptiveRate {
+		fmt.Fprintf(os.Stderr, "Error: --rate-decrease and --rate-increase require --adaptive-rate\n")
+		os.Exit(1)
+	}
+	if rateDecrease <= 0 || rateDecrease >= 1 {
+		fmt.Fprintf(os.Stderr, "Error: --rate-decrease must be between 0 and 1\n")
+		os.Exit(1)
+	}
+	if rateIncrease <= 0 {
+		fmt.Fprintf(os.Stderr, "Error: --rate-increase must be greater than 0\n")
+		os.Exit(1)
+	}
+	if rate > 0 {
+		limiter = newRateLimiter(rate, ramp)
+		limiter.adaptive = adaptiveRate
+	}
+
+	stopStatuses, err := parseStatusRanges(stopOnStatus)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error: --stop-on-status: %v\n", err)
+		os.Exit(1)
+	}
+	healthStatuses, err := parseStatusRanges(healthExpectStatus)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error: --health-expect-status: %v\n", err)
+		os.Exit(1)
+	}
+
+	if outputFile != "" {
+		f, err := os.OpenFile(outputFile, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644)
 		if err != nil {
-			return fmt.Errorf("evaluating header expression: %w", err)
+			fmt.Fprintf(os.Stderr, "Error opening output file: %v\n", err)
+			os.Exit(1)
 		}
+		defer f.Close()
 
-		// Parse header string (format: "Header-Name: Value")
-		headerStr := fmt.Sprintf("%v", headerValue)
-		parts := strings.SplitN(headerStr, ":", 2)
-		if len(parts) == 2 {
-			req.Header.Set(strings.TrimSpace(parts[0]), strings.TrimSpace(parts[1]))
+		// Files are unbuffered, so each result reaches the file as it's
+		// written
+		if tee {
+			output = &lockedWriter{w: io.MultiWriter(os.Stdout, f)}
 		} else {
-			return fmt.Errorf("invalid header format: %s", headerStr)
+			output = f
 		}
+	} else if tee {
+		fmt.Fprintf(os.Stderr, "Error: --tee requires --output-file\n")
+		os.Exit(1)
 	}
 
-	// In dry-run mode, print the request instead of sending it
-	if dryRun {
-		fmt.Printf("=== DRY RUN ===\n")
-		fmt.Printf("Method: %s\n", req.Method)
-		fmt.Printf("URL: %s\n", req.URL)
-		fmt.Printf("Headers:\n")
-		for name, values := range req.Header {
-			for _, value := range values {
-				fmt.Printf("  %s: %s\n", name, value)
+	// Replaying into the file being replayed would never finish
+	if replayPath != "" && deadLetterPath != "" {
+		replayInfo, replayErr := os.Stat(replayPath)
+		deadLetterInfo, deadLetterErr := os.Stat(deadLetterPath)
+		if replayErr == nil && deadLetterErr == nil && os.SameFile(replayInfo, deadLetterInfo) {
+			fmt.Fprintf(os.Stderr, "Error: --dead-letter-file must be a different file from --replay\n")
+			os.Exit(1)
+		}
+	}
+
+	if deadLetters != nil {
+		if err := deadLetters.open(deadLetterPath); err != nil {
+			fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+			os.Exit(1)
+		}
+		defer func() {
+			if err := deadLetters.Close(); err != nil {
+				fmt.Fprintf(os.Stderr, "Error writing dead letter: %v\n", err)
+			}
+		}()
+	}
+
+	var audit *auditFile
+	if auditPath != "" {
+		audit, err = openAuditFile(auditPath)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+			os.Exit(1)
+		}
+		defer func() {
+			if err := audit.Close(); err != nil {
+				fmt.Fprintf(os.Stderr, "Error writing audit record: %v\n", err)
+			}
+		}()
+	}
+
+	// With --checkpoint-file, progress is saved as lines are finished, and
+	// with --resume, the lines finished by an earlier run are skipped. Dry
+	// runs resume but don't save their progress, since nothing was sent
+	var resumeFrom int64
+	if resume {
+		resumeFrom, err = readCheckpoint(checkpointPath)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+			os.Exit(1)
+		}
+		if resumeFrom > 0 {
+			fmt.Fprintf(os.Stderr, "Resuming after line %d\n", resumeFrom)
+		}
+	}
+	var checkpoint *checkpointFile
+	if checkpointPath != "" && !dryRun {
+		checkpoint = &checkpointFile{path: checkpointPath, every: checkpointEvery, done: resumeFrom, saved: resumeFrom}
+	}
+	finishLines := func(n int64) {
+		if checkpoint != nil {
+			if err := checkpoint.finished(n); err != nil {
+				fmt.Fprintf(os.Stderr, "Error: %v\n", err)
 			}
 		}
-		fmt.Printf("Body: %s\n", string(bodyBytes))
-		fmt.Printf("===============\n\n")
-		return nil
 	}
 
-	// Send request
-	resp, err := client.Do(req)
+	// Buffered records are written before exiting, since deferred Closes
+	// don't run on os.Exit
+	flushRecords := func() {
+		if checkpoint != nil {
+			if err := checkpoint.save(); err != nil {
+				fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+			}
+		}
+		if deadLetters != nil {
+			if err := deadLetters.Flush(); err != nil {
+				fmt.Fprintf(os.Stderr, "Error writing dead letter: %v\n", err)
+			}
+		}
+		if audit != nil {
+			if err := audit.Flush(); err != nil {
+				fmt.Fprintf(os.Stderr, "Error writing audit record: %v\n", err)
+			}
+		}
+	}
+
+	var delimiter []byte
+	if inputDelimiter != "" {
+		delimiter, err = parseDelimiter(inputDelimiter)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+			os.Exit(1)
+		}
+	}
+
+	paths, err := inputPathsFor(inputFilePaths, inputGlob)
 	if err != nil {
-		return fmt.Errorf("sending request: %w", err)
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		os.Exit(1)
+	}
+	var in io.Reader = os.Stdin
+	var files *inputFiles
+	if len(paths) > 0 {
+		files = &inputFiles{paths: paths, separator: delimiter}
+		defer files.Close()
+		in = files
+	} else if replayPath != "" {
+		replay, err := openReplay(replayPath)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error opening replay file: %v\n", err)
+			os.Exit(1)
+		}
+		defer replay.Close()
+		in = replay
+	}
+	if inputLimitBytes != "" {
+		limit, err := parseByteSize(inputLimitBytes)
+		if err != nil || limit == 0 {
+			fmt.Fprintf(os.Stderr, "Error: --input-limit-bytes must be a size greater than 0\n")
+			os.Exit(1)
+		}
+		readLimit = limitInput(in, limit)
+		in = readLimit
 	}
-	defer resp.Body.Close()
 
-	// Read response
-	respBody := new(bytes.Buffer)
-	respBody.ReadFrom(resp.Body)
+	// Records from stdin have the source -, and those from files the path
+	// of the file they were read from
+	scanner := bufio.NewScanner(in)
+	split := bufio.ScanLines
+	if delimiter != nil {
+		split = splitOn(delimiter)
+	}
+	if readLimit != nil {
+		split = readLimit.split(split)
+	}
+	source := func() string { return "-" }
+	if files != nil {
+		tracker := &sourceTracker{files: files, split: split}
+		split, source = tracker.scan, tracker.source
+	} else if replayPath != "" {
+		source = func() string { return replayPath }
+	}
+	scanner.Split(split)
+	client, err := newClient()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		os.Exit(1)
+	}
 
-	// Output response
-	fmt.Printf("Status: %s, Response: %s\n", resp.Status, respBody.String())
+	ctx := context.Background()
+	if deadline > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, deadline)
+		defer cancel()
 
-	if resp.StatusCode >= 400 {
-		return fmt.Errorf("HTTP error: %s", resp.Status)
+		// Closing stdin unblocks a pending read once the deadline passes,
+		// unless it's to be drained
+		go func() {
+			<-ctx.Done()
+			if ctx.Err() == context.DeadlineExceeded && !drainStdin {
+				os.Stdin.Close()
+			}
+		}()
 	}
 
-	return nil
-}
+	// Make sure the service is up before reading any input
+	if waitForURL != "" {
+		fmt.Fprintf(os.Stderr, "Waiting for %s\n", waitForURL)
+		if err := waitForHealthy(ctx, client, waitForURL, healthStatuses, waitInterval, waitTimeout); err != nil {
+			fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+			os.Exit(1)
+		}
+	}
+	if healthURL != "" {
+		if err := checkHealth(ctx, client, healthURL, healthStatuses); err != nil {
+			fmt.Fprintf(os.Stderr, "Health check failed: %v\n", err)
+			os.Exit(1)
+		}
+	}
 
-func evaluateExpression(expression string, env map[string]interface{}) (interface{}, error) {
-	program, err := expr.Compile(expression, expr.Env(env))
-	if err != nil {
-		return nil, err
+	// Fetch the value shared by every line before reading any input
+	if bootstrapURL != "" {
+		bootstrapValue, err = runBootstrap(ctx, client, bootstrapURL, exprs.bootstrapHeaders, exprs.bootstrap)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Bootstrap failed: %v\n", err)
+			os.Exit(1)
+		}
 	}
 
-	return expr.Run(program, env)
-}
+	if preflight {
+		runPreflight(ctx, scanner, source, exprs, client)
+		return
+	}
 
-func getEnvMap() map[string]string {
-	envMap := make(map[string]string)
-	for _, e := range os.Environ() {
-		pair := strings.SplitN(e, "=", 2)
-		if len(pair) == 2 {
-			envMap[pair[0]] = pair[1]
+	parsed, readErr := parseLines(scanner, parseWorkers, source)
+	wentIdle := func() bool { return false }
+	if idleTimeout > 0 {
+		parsed, wentIdle = untilIdle(parsed, idleTimeout)
+	}
+	if shuffle {
+		seed := shuffleSeed
+		if !cmd.Flags().Changed("seed") && !configured["seed"] {
+			seed = time.Now().UnixNano()
 		}
+		parsed = shuffled(parsed, mathrand.New(mathrand.NewSource(seed)), memoryLimit)
 	}
-	return envMap
+	var parseErrors int
+	stats := newRunStats()
+
+	// With --summary-json and --histogram, the summary is written however
+	// the run ends
+	writeSummary := func() {
+		if histogram {
+			if err := writeHistogram(output, stats); err != nil {
+				fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+			}
+		}
+		if summaryJSON == "" {
+			return
+		}
+		if err := writeSummaryJSON(summaryJSON, stats); err != nil {
+			fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		}
+	}
+
+	// With --drain-stdin, stopping early reads the rest of stdin so the
+	// producer can finish writing instead of getting a broken pipe
+	drain := func() {
+		if drainStdin && readingStdin() {
+			for range parsed {
+			}
+		}
+	}
+
+	// lineNumber counts the lines read, including any skipped by --resume
+	var lineNumber int64
+	stopped := false
+
+	// With --confirm-after, the run pauses once this many requests have
+	// been sent
+	var sent, sentFailed int
+	awaitingCanary := confirmAfter > 0 && !assumeYes
+
+	// The deadline is checked alongside the input, since closing stdin
+	// doesn't interrupt a read that's already waiting
+lines:
+	for {
+		var p parsedLine
+		select {
+		case next, ok := <-parsed:
+			if !ok {
+				break lines
+			}
+			p = next
+		case <-ctx.Done():
+			stopped = true
+			break lines
+		}
+		// Every line before this one has been finished
+		finishLines(lineNumber)
+		lineNumber++
+		if lineNumber <= resumeFrom {
+			continue
+		}
+
+		line := p.line
+		stats.processed++
+		if p.err != nil {
+			reportFailure("", line, p.err)
+			stats.parseError()
+			parseErrors++
+			if maxParseErrors > 0 && parseErrors > maxParseErrors {
+				fmt.Fprintf(os.Stderr, "Stopping: more than %d lines were not valid JSON\n", maxParseErrors)
+				writeSummary()
+				flushRecords()
+				drain()
+				os.Exit(1)
+			}
+			continue
+		}
+		input := p.input
+
+		// With --input-jsonpath, each record the path selects is sent
+		// separately, and with --explode, so is each element of an array
+		inputs := []interface{}{input}
+		split := false
+		if exprs.inputPath != nil {
+			inputs, split = exprs.inputPath.selectFrom(input), true
+		}
+		if explode {
+			var exploded []interface{}
+			for _, record := range inputs {
+				if elements, ok := record.([]interface{}); ok {
+					exploded = append(exploded, elements...)
+					split = true
+				} else {
+					exploded = append(exploded, record)
+				}
+			}
+			inputs = exploded
+		}
+		if len(inputs) == 0 {
+			stats.skipped++
+		}
+
+		for index, input := range inputs {
+			// The original line of a record split from the line is the
+			// record itself
+			raw := line
+			if split {
+				data, _ := json.Marshal(input)
+				raw = string(data)
+			}
+
+			for _, env := range inputEnvs(input) {
+				env["source"] = p.source
+				// Identify which part of the line failed in errors
+				label := ""
+				if split {
+					label += fmt.Sprintf(" (element %d)", index)
+				}
+				if key, ok := env["key"]; ok {
+					label += fmt.Sprintf(" (field %q)", key)
+				}
+
+				for i := 0; i < repeat; i++ {
+					if ctx.Err() != nil {
+						stopped = true
+						break lines
+					}
+					if requestLimitReached() {
+						fmt.Fprintf(os.Stderr, "Stopping: sent the maximum of %d requests\n", maxRequests)
+						stopped = true
+						break lines
+					}
+					if awaitingCanary && sent >= confirmAfter {
+						awaitingCanary = false
+						if err := confirmContinue(sent, sentFailed); err != nil {
+							fmt.Fprintf(os.Stderr, "Stopping: %v\n", err)
+							writeSummary()
+							flushRecords()
+							drain()
+							os.Exit(1)
+						}
+					}
+
+					// With --confirm, the first request waits for the
+					// user's go-ahead
+					var result lineResult
+					var err error
+					if awaitingConfirmation {
+						result, err = confirmFirstRequest(ctx, env, exprs, client)
+					} else {
+						result, err = processLineWithTimeout(ctx, env, exprs, client)
+					}
+					if errors.Is(err, errNotConfirmed) {
+						fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+						writeSummary()
+						flushRecords()
+						drain()
+						os.Exit(1)
+					}
+					if result.request != nil {
+						sent++
+						if err != nil {
+							sentFailed++
+						}
+					}
+					if audit != nil {
+						if auditErr := audit.record(env, result, err); auditErr != nil {
+							fmt.Fprintf(os.Stderr, "Error writing audit record: %v\n", auditErr)
+						}
+					}
+					if err != nil && deadLetters != nil {
+						if dlErr := deadLetters.record(raw, env, result, err); dlErr != nil {
+							fmt.Fprintf(os.Stderr, "Error writing dead letter: %v\n", dlErr)
+						}
+					}
+					stats.record(result, err)
+					if stopStatuses.contains(result.status) {
+						fmt.Fprintf(os.Stderr, "Stopping: received status %d %s\n", result.status, http.StatusText(result.status))
+						writeSummary()
+						flushRecords()
+						drain()
+						os.Exit(1)
+					}
+					if err != nil {
+						reportFailure(label, raw, err)
+					}
+					if errors.Is(err, errRequestLimit) {
+						fmt.Fprintf(os.Stderr, "Stopping: sent the maximum of %d requests\n", maxRequests)
+						stopped = true
+						break lines
+					}
+				}
+			}
+		}
+	}
+
+	if !stopped {
+		finishLines(lineNumber)
+	}
+
+	if countOnly {
+		fmt.Fprintf(output, "Requests: %d, Errors: %d\n", stats.ok, stats.failed)
+	}
+	writeSummary()
+	flushRecords()
+
+	if budget != nil {
+		fmt.Fprintf(os.Stderr, "Retries: %d of %d budget used\n", retryCount.Load(), budget.limit)
+	}
+
+	if ctx.Err() == context.DeadlineExceeded {
+		fmt.Fprintf(os.Stderr, "Stopping: deadline of %s exceeded\n", deadline)
+		drain()
+		os.Exit(1)
+	}
+
+	// After stopping early, as after going idle, a read may still be
+	// pending, so the input isn't checked for errors
+	if stopped {
+		drain()
+	} else if wentIdle() {
+		fmt.Fprintf(os.Stderr, "Stopping: no input for %s\n", idleTimeout)
+	} else if err := readErr(); err != nil {
+		fmt.Fprintf(os.Stderr, "Error reading input: %v\n", err)
+		os.Exit(1)
+	} else if readLimit.reached() {
+		fmt.Fprintf(os.Stderr, "Stopping: read the --input-limit-bytes limit of %s", inputLimitBytes)
+		if readLimit.dropped > 0 {
+			fmt.Fprintf(os.Stderr, "; dropped the incomplete last line (%d bytes)", readLimit.dropped)
+		}
+		fmt.Fprintln(os.Stderr)
+	}
+
+	// Failed lines only change the exit status when asked to, except with
+	// --count-only, which is run to find them
+	if stats.failed > 0 && errorExitCode != 0 {
+		os.Exit(errorExitCode)
+	} else if stats.failed > 0 && countOnly {
+		os.Exit(1)
+	}
+}
+
+// reportFailure reports a line that failed. With --errors-only, failures
+// are written to the output along with their input; otherwise they're
+// logged to stderr.
+func reportFailure(label string, raw string, err error) {
+	if histogram {
+		return
+	}
+	if errorsOnly {
+		fmt.Fprintf(output, "Failed%s: %v, Input: %s\n", label, err, raw)
+		return
+	}
+	fmt.Fprintf(os.Stderr, "Error processing line%s: %v\n", label, err)
+}
+
+// standardMethods are the HTTP methods accepted without a warning.
+var standardMethods = map[string]bool{
+	http.MethodGet:     true,
+	http.MethodHead:    true,
+	http.MethodPost:    true,
+	http.MethodPut:     true,
+	http.MethodPatch:   true,
+	http.MethodDelete:  true,
+	http.MethodConnect: true,
+	http.MethodOptions: true,
+	http.MethodTrace:   true,
+}
+
+// checkRequirements evaluates the compiled --require expressions for a
+// line, returning an error naming the first that isn't true.
+func checkRequirements(compiled []*compiledExpression, env map[string]interface{}) error {
+	for i, requirement := range compiled {
+		result, err := requirement.evaluate(env)
+		if err != nil {
+			return fmt.Errorf("evaluating requirement %s: %w", requirements[i], err)
+		}
+		if ok, isBool := result.(bool); !isBool {
+			return fmt.Errorf("requirement %s returned %T, not bool", requirements[i], result)
+		} else if !ok {
+			return fmt.Errorf("requirement not met: %s", requirements[i])
+		}
+	}
+	return nil
+}
+
+// lineMethod evaluates the --method-expr expression for a line and maps
+// the result to an HTTP method with --method-map. Without a mapping, the
+// result is used as the method itself.
+func lineMethod(expression *compiledExpression, env map[string]interface{}) (string, error) {
+	result, err := expression.evaluate(env)
+	if err != nil {
+		return "", fmt.Errorf("evaluating method expression: %w", err)
+	}
+	value := fmt.Sprintf("%v", result)
+	if len(methodMap) > 0 {
+		mapped, ok := methodMap[value]
+		if !ok {
+			return "", fmt.Errorf("no method mapped for %q", value)
+		}
+		value = mapped
+	}
+	method := strings.ToUpper(strings.TrimSpace(value))
+	if method == "" || strings.IndexFunc(method, func(r rune) bool { return !isTokenChar(r) }) >= 0 {
+		return "", fmt.Errorf("invalid method %q", value)
+	}
+	return method, nil
+}
+
+// bodylessMethods are sent without a body, so their body expressions are
+// never evaluated.
+var bodylessMethods = map[string]bool{
+	http.MethodGet:   true,
+	http.MethodHead:  true,
+	http.MethodTrace: true,
+}
+
+// ignoredBodyWarning makes sure the body flags dropped for a bodyless
+// method are only warned about once.
+var ignoredBodyWarning sync.Once
+
+// warnIgnoredBody warns that the flags producing the body are ignored,
+// since requests with method are sent without one.
+func warnIgnoredBody(method string) {
+	ignoredBodyWarning.Do(func() {
+		var flags []string
+		if transformFile != "" {
+			flags = append(flags, "--transform-file")
+		} else if transform != "" {
+			flags = append(flags, "--transform")
+		}
+		if jqTransform {
+			flags = append(flags, "--jq")
+		}
+		if templateBody != "" {
+			flags = append(flags, "--template-body")
+		}
+		if bodyField != "" {
+			flags = append(flags, "--body-field")
+		}
+		if defaultBody != "input" {
+			flags = append(flags, "--default-body")
+		}
+		if len(flags) > 0 {
+			fmt.Fprintf(os.Stderr, "Warning: ignoring %s, since %s requests are sent without a body\n", strings.Join(flags, ", "), method)
+		}
+	})
+}
+
+// normalizeMethod uppercases an HTTP method and checks that it's a valid
+// token. Extension methods are allowed with a warning.
+func normalizeMethod(method string) (string, error) {
+	method = strings.ToUpper(strings.TrimSpace(method))
+	if method == "" {
+		return "", fmt.Errorf("method is empty")
+	}
+	for _, r := range method {
+		if !isTokenChar(r) {
+			return "", fmt.Errorf("invalid method %q", method)
+		}
+	}
+	if !standardMethods[method] {
+		fmt.Fprintf(os.Stderr, "Warning: %s is not a standard HTTP method\n", method)
+	}
+	return method, nil
+}
+
+// isTokenChar reports whether r may appear in an HTTP token (RFC 9110).
+func isTokenChar(r rune) bool {
+	switch {
+	case r >= 'A' && r <= 'Z', r >= 'a' && r <= 'z', r >= '0' && r <= '9':
+		return true
+	}
+	return strings.ContainsRune("!#$%&'*+-.^_`|~", r)
+}
+
+// runPreflight sends a single request for the first non-blank input line,
+// or for an empty object if there are no input files and stdin is a
+// terminal, and exits non-zero if it fails.
+func runPreflight(ctx context.Context, scanner *bufio.Scanner, source func() string, exprs *expressions, client *http.Client) {
+	line := "{}"
+	if !readingStdin() || !isTerminal(os.Stdin) {
+		for scanner.Scan() {
+			if strings.TrimSpace(scanner.Text()) != "" {
+				line = strings.TrimSuffix(scanner.Text(), "\r")
+				break
+			}
+		}
+		if err := scanner.Err(); err != nil {
+			fmt.Fprintf(os.Stderr, "Error reading input: %v\n", err)
+			os.Exit(1)
+		}
+	}
+
+	input, err := parseLine(line)
+	if err == nil {
+		env := newEnv(input)
+		env["source"] = source()
+		if awaitingConfirmation {
+			_, err = confirmFirstRequest(ctx, env, exprs, client)
+		} else {
+			_, err = processLine(ctx, env, exprs, client)
+		}
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Preflight failed: %v\n", err)
+		os.Exit(1)
+	}
+	fmt.Fprintf(os.Stderr, "Preflight succeeded\n")
+}
+
+// isTerminal reports whether f is a character device such as a terminal.
+func isTerminal(f *os.File) bool {
+	info, err := f.Stat()
+	if err != nil {
+		return false
+	}
+	return info.Mode()&os.ModeCharDevice != 0
+}
+
+// expressions holds the compiled URL, transform, and header expressions
+// shared by every line.
+type expressions struct {
+	urlExpr   string
+	url       *compiledExpression // nil when urlExpr is a plain URL
+	transform *compiledExpression
+	jq        *jqProgram // used instead of transform with --jq
+	headers   []*compiledExpression
+	requestID *compiledExpression
+	reauth    *compiledExpression
+	onSuccess *compiledExpression
+	status    *compiledExpression // decides success instead of the HTTP status
+	method    *compiledExpression
+	require   []*compiledExpression
+	carry     []carriedHeader
+	output    *template.Template
+
+	bodyTemplate *template.Template // used instead of transform with --template-body
+	inputPath    *jsonPath          // selects the records in each line
+
+	bootstrapHeaders []*compiledExpression
+	bootstrap        *compiledExpression // extracts bootstrap from the --bootstrap-url response
+}
+
+func compileExpressions(urlExpr string) (*expressions, error) {
+	exprs := &expressions{urlExpr: urlExpr}
+
+	// A URL that doesn't compile is used as a plain string
+	if program, err := compileExpression(urlExpr, exprEnv); err == nil {
+		exprs.url = program
+	}
+
+	var err error
+	if transform != "" && jqTransform {
+		exprs.jq, err = compileJQ(transform)
+		if err != nil {
+			return nil, fmt.Errorf("compiling jq transform: %w", err)
+		}
+	} else if transform != "" {
+		exprs.transform, err = compileExpression(transform, exprEnv)
+		if err != nil {
+			return nil, fmt.Errorf("compiling transform expression: %w", err)
+		}
+	}
+
+	for _, header := range headers {
+		program, err := compileExpression(header, exprEnv)
+		if err != nil {
+			return nil, fmt.Errorf("compiling header expression: %w", err)
+		}
+		exprs.headers = append(exprs.headers, program)
+	}
+
+	if requestIDExpr != "" {
+		exprs.requestID, err = compileExpression(requestIDExpr, exprEnv)
+		if err != nil {
+			return nil, fmt.Errorf("compiling request ID expression: %w", err)
+		}
+	}
+
+	if reauthExpr != "" {
+		exprs.reauth, err = compileExpression(reauthExpr, responseExprEnv)
+		if err != nil {
+			return nil, fmt.Errorf("compiling reauth expression: %w", err)
+		}
+	}
+
+	if statusExpr != "" {
+		exprs.status, err = compileExpression(statusExpr, responseExprEnv)
+		if err != nil {
+			return nil, fmt.Errorf("compiling status expression: %w", err)
+		}
+	}
+
+	if onSuccess != "" {
+		exprs.onSuccess, err = compileExpression(onSuccess, responseExprEnv)
+		if err != nil {
+			return nil, fmt.Errorf("compiling on-success expression: %w", err)
+		}
+	}
+
+	if inputJSONPath != "" {
+		exprs.inputPath, err = compileJSONPath(inputJSONPath)
+		if err != nil {
+			return nil, fmt.Errorf("compiling input JSONPath: %w", err)
+		}
+	}
+
+	if templateBody != "" {
+		exprs.bodyTemplate, err = template.New("body").Funcs(templateFunctions).Parse(templateBody)
+		if err != nil {
+			return nil, fmt.Errorf("parsing body template: %w", err)
+		}
+	}
+
+	exprs.carry, err = parseCarriedHeaders(carryHeaders)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, requirement := range requirements {
+		program, err := compileExpression(requirement, exprEnv)
+		if err != nil {
+			return nil, fmt.Errorf("compiling requirement %q: %w", requirement, err)
+		}
+		exprs.require = append(exprs.require, program)
+	}
+
+	if methodExpr != "" {
+		exprs.method, err = compileExpression(methodExpr, exprEnv)
+		if err != nil {
+			return nil, fmt.Errorf("compiling method expression: %w", err)
+		}
+	}
+
+	for _, header := range bootstrapHeaders {
+		program, err := compileExpression(header, exprEnv)
+		if err != nil {
+			return nil, fmt.Errorf("compiling bootstrap header expression: %w", err)
+		}
+		exprs.bootstrapHeaders = append(exprs.bootstrapHeaders, program)
+	}
+
+	if bootstrapExpr != "" {
+		exprs.bootstrap, err = compileExpression(bootstrapExpr, responseExprEnv)
+		if err != nil {
+			return nil, fmt.Errorf("compiling bootstrap expression: %w", err)
+		}
+	}
+
+	exprs.output, err = compileOutputTemplate(outputTemplate)
+	if err != nil {
+		return nil, fmt.Errorf("parsing output template: %w", err)
+	}
+
+	return exprs, nil
+}
+
+// parseLine parses a line of JSON input.
+func parseLine(line string) (interface{}, error) {
+	if jsonNumbers {
+		return parsePrecise(line)
+	}
+	var input interface{}
+	if err := json.Unmarshal([]byte(line), &input); err != nil {
+		return nil, fmt.Errorf("parsing JSON: %w", err)
+	}
+	return input, nil
+}
+
+// lineResult is the outcome of sending the request for a line.
+type lineResult struct {
+	status   int           // response status code, or 0 if no response was received
+	response []byte        // response body
+	latency  time.Duration // time taken to get the response, including retries
+	request  *http.Request // the request sent, or nil if none was
+	outcome  string        // the class --status-expr put the response in, if any
+
+	succeeded bool              // the response is to be prev for later lines
+	carried   map[string]string // --carry-header values from the response
+}
+
+// missingEnv returns the environment variables referenced by the
+// expressions, along with extra ones and the --template-body template,
+// that aren't set in env.
+func (exprs *expressions) missingEnv(env map[string]string, extra ...*compiledExpression) []string {
+	all := append([]*compiledExpression{exprs.url, exprs.transform, exprs.requestID, exprs.reauth, exprs.onSuccess, exprs.status, exprs.method, exprs.bootstrap}, exprs.headers...)
+	all = append(all, exprs.bootstrapHeaders...)
+	all = append(all, exprs.require...)
+	all = append(all, extra...)
+
+	var keys []string
+	for _, c := range all {
+		if c != nil {
+			keys = append(keys, c.envKeys...)
+		}
+	}
+	if exprs.bodyTemplate != nil {
+		keys = append(keys, templateEnvKeys(exprs.bodyTemplate)...)
+	}
+
+	var missing []string
+	seen := make(map[string]bool)
+	for _, key := range keys {
+		if _, ok := env[key]; !ok && !seen[key] {
+			seen[key] = true
+			missing = append(missing, key)
+		}
+	}
+	return missing
+}
+
+// processLineWithTimeout runs processLine, giving up on the line once
+// --line-timeout passes.
+func processLineWithTimeout(ctx context.Context, env map[string]interface{}, exprs *expressions, client *http.Client) (lineResult, error) {
+	return withLineTimeout(ctx, env, func(ctx context.Context, env map[string]interface{}) (lineResult, error) {
+		return processLine(ctx, env, exprs, client)
+	})
+}
+
+// errNotConfirmed is returned when the --confirm prompt isn't answered
+// yes, and stops the run.
+var errNotConfirmed = errors.New("no requests were sent")
+
+// confirmFirstRequest builds the request for a line and shows it for
+// --confirm's go-ahead before sending it. The prompt is outside of
+// --line-timeout, which starts once the request is confirmed, and lines
+// after this one are only sent without asking once it has been.
+func confirmFirstRequest(ctx context.Context, env map[string]interface{}, exprs *expressions, client *http.Client) (lineResult, error) {
+	prepared, err := prepareRequest(ctx, env, exprs)
+	if err != nil {
+		return lineResult{}, err
+	}
+	if err := confirmRequest(prepared.req, prepared.requestID, prepared.encodedBody()); err != nil {
+		return lineResult{}, fmt.Errorf("%v; %w", err, errNotConfirmed)
+	}
+	awaitingConfirmation = false
+
+	return withLineTimeout(ctx, env, func(ctx context.Context, env map[string]interface{}) (lineResult, error) {
+		return sendPrepared(ctx, env, exprs, client, prepared)
+	})
+}
+
+// withLineTimeout runs process for a line, giving up on it once
+// --line-timeout passes. The request is cancelled, but an expression that
+// is still being evaluated can't be interrupted and is abandoned in the
+// background with its own copy of env.
+func withLineTimeout(ctx context.Context, env map[string]interface{}, process func(context.Context, map[string]interface{}) (lineResult, error)) (lineResult, error) {
+	if lineTimeout <= 0 {
+		result, err := process(ctx, env)
+		publishResult(result)
+		return result, err
+	}
+
+	lineCtx, cancel := context.WithTimeout(ctx, lineTimeout)
+	defer cancel()
+
+	lineEnv := make(map[string]interface{}, len(env))
+	for k, v := range env {
+		lineEnv[k] = v
+	}
+
+	type outcome struct {
+		result lineResult
+		err    error
+	}
+	done := make(chan outcome, 1)
+	go func() {
+		result, err := process(lineCtx, lineEnv)
+		done <- outcome{result, err}
+	}()
+
+	select {
+	case o := <-done:
+		publishResult(o.result)
+		return o.result, o.err
+	case <-lineCtx.Done():
+		if ctx.Err() != nil {
+			return lineResult{}, ctx.Err()
+		}
+		return lineResult{}, fmt.Errorf("line timed out after %s", lineTimeout)
+	}
+}
+
+// preparedRequest is the request built for a line, ready to be sent.
+type preparedRequest struct {
+	req       *http.Request
+	requestID string
+	body      interface{} // encoded as the request is sent when stream is set
+	bodyBytes []byte
+	stream    bool
+}
+
+// encodedBody returns the body of the request for printing, encoding a
+// streamed body in full.
+func (p *preparedRequest) encodedBody() []byte {
+	if p.stream {
+		data, _ := json.Marshal(p.body)
+		return data
+	}
+	return p.bodyBytes
+}
+
+// processLine sends the request for a single line. env holds the
+// expression variables for the line, including its input.
+func processLine(ctx context.Context, env map[string]interface{}, exprs *expressions, client *http.Client) (lineResult, error) {
+	prepared, err := prepareRequest(ctx, env, exprs)
+	if err != nil {
+		return lineResult{}, err
+	}
+
+	// In dry-run mode, print the request instead of sending it
+	if countOnly {
+		return lineResult{}, nil
+	}
+	if dryRun {
+		var buf bytes.Buffer
+		fmt.Fprintf(&buf, "=== DRY RUN ===\n")
+		printRequest(&buf, prepared.req, prepared.requestID, prepared.bodyBytes)
+		fmt.Fprintf(&buf, "===============\n\n")
+		output.Write(buf.Bytes())
+		return lineResult{}, nil
+	}
+
+	return sendPrepared(ctx, env, exprs, client, prepared)
+}
+
+// prepareRequest evaluates a line's expressions and builds its request.
+func prepareRequest(ctx context.Context, env map[string]interface{}, exprs *expressions) (*preparedRequest, error) {
+	input := env["input"]
+	env["prev"] = lastResponse()
+	env["attempt"] = 0
+
+	if err := checkRequirements(exprs.require, env); err != nil {
+		return nil, err
+	}
+
+	// Evaluate URL expression or use as-is if not a valid expression
+	urlStr := exprs.urlExpr
+	if exprs.url != nil {
+		// If evaluation fails, use the URL as a plain string
+		if urlResult, err := exprs.url.evaluate(env); err == nil {
+			urlStr = fmt.Sprintf("%v", urlResult)
+		}
+	}
+
+	method := requestMethod
+	if exprs.method != nil {
+		var err error
+		method, err = lineMethod(exprs.method, env)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	// Transform input if specified
+	var body interface{}
+	var noBody bool
+	var err error
+	if bodylessMethods[method] {
+		noBody = true
+		warnIgnoredBody(method)
+	} else if exprs.jq != nil {
+		body, err = exprs.jq.evaluate(input)
+		if err != nil {
+			return nil, fmt.Errorf("evaluating jq transform: %w", err)
+		}
+	} else if exprs.transform != nil {
+		body, err = exprs.transform.evaluate(env)
+		if err != nil {
+			return nil, fmt.Errorf("evaluating transform expression: %w", err)
+		}
+	} else if exprs.bodyTemplate != nil {
+		body, err = renderBodyTemplate(exprs.bodyTemplate, env)
+		if err != nil {
+			return nil, err
+		}
+	} else if bodyField != "" {
+		var found bool
+		body, found = lookupPath(input, bodyField)
+		if !found {
+			return nil, fmt.Errorf("body field %s not found in input", bodyField)
+		}
+	} else if defaultBody == "empty" {
+		body = map[string]interface{}{}
+	} else if defaultBody == "none" {
+		noBody = true
+	} else {
+		body = input
+	}
+	for _, path := range dropFields {
+		body = withoutPath(body, path)
+	}
+	if stripNulls {
+		body = withoutNulls(body)
+	}
+
+	// Marshal body to JSON, unless it's a string to be sent verbatim or
+	// it's to be encoded as the request is sent
+	var bodyBytes []byte
+	var stream bool
+	s, isString := body.(string)
+	verbatim := isString && (bodyString || exprs.bodyTemplate != nil)
+	if noBody {
+		bodyBytes = nil
+	} else if verbatim {
+		bodyBytes = []byte(s)
+	} else if streamBody && !dryRun {
+		stream = true
+	} else {
+		bodyBytes, err = json.Marshal(body)
+		if err != nil {
+			return nil, fmt.Errorf("marshaling body: %w", err)
+		}
+	}
+
+	if validateJSON != "" && !noBody {
+		if err := checkBodyType(body, bodyBytes, verbatim); err != nil {
+			return nil, err
+		}
+	}
+
+	if frameLengthPrefix && !noBody {
+		bodyBytes = framed(bodyBytes)
+	}
+
+	// Create HTTP request
+	var bodyReader io.Reader = bytes.NewReader(bodyBytes)
+	if stream {
+		bodyReader = encodeJSONStream(body)
+	} else if noBody {
+		bodyReader = nil
+	}
+	req, err := http.NewRequestWithContext(ctx, method, urlStr, bodyReader)
+	if err != nil {
+		return nil, fmt.Errorf("creating request: %w", err)
+	}
+	if stream {
+		req.GetBody = func() (io.ReadCloser, error) {
+			return encodeJSONStream(body), nil
+		}
+	}
+
+	if !noContentType && !noBody {
+		req.Header.Set("Content-Type", contentType)
+	}
+
+	if bearerToken != nil {
+		token, err := bearerToken.read()
+		if err != nil {
+			return nil, err
+		}
+		setHeader(req.Header, "Authorization", "Bearer "+token)
+	}
+
+	// Add headers carried from the last response, then those given with
+	// --header, which take precedence
+	setCarriedHeaders(req.Header)
+	if err := setHeaders(req.Header, exprs.headers, env); err != nil {
+		return nil, err
+	}
+
+	// Add request ID header
+	var requestID string
+	if requestIDHeader != "" {
+		if exprs.requestID != nil {
+			idValue, err := exprs.requestID.evaluate(env)
+			if err != nil {
+				return nil, fmt.Errorf("evaluating request ID expression: %w", err)
+			}
+			requestID = fmt.Sprintf("%v", idValue)
+		} else {
+			requestID, err = newUUID()
+			if err != nil {
+				return nil, fmt.Errorf("generating request ID: %w", err)
+			}
+		}
+		setHeader(req.Header, requestIDHeader, requestID)
+	}
+
+	return &preparedRequest{req: req, requestID: requestID, body: body, bodyBytes: bodyBytes, stream: stream}, nil
+}
+
+// sendPrepared sends a line's prepared request and handles its response.
+func sendPrepared(ctx context.Context, env map[string]interface{}, exprs *expressions, client *http.Client, prepared *preparedRequest) (lineResult, error) {
+	input := env["input"]
+	req := prepared.req.WithContext(ctx)
+	requestID := prepared.requestID
+
+	if preRequest != "" {
+		if err := runPreRequest(preRequest, req, prepared.encodedBody(), input); err != nil {
+			return lineResult{}, err
+		}
+	}
+
+	// Headers that reference attempt are re-evaluated before each retry
+	var perAttempt []*compiledExpression
+	for _, header := range exprs.headers {
+		if header.perAttempt {
+			perAttempt = append(perAttempt, header)
+		}
+	}
+	var prepareRetry func(*http.Request, int) error
+	if len(perAttempt) > 0 {
+		prepareRetry = func(retry *http.Request, attempt int) error {
+			env["attempt"] = attempt
+			return setHeaders(retry.Header, perAttempt, env)
+		}
+	}
+
+	// Send request
+	start := time.Now()
+	resp, respBody, err := sendWithRetries(client, req, prepareRetry)
+	if err != nil {
+		return lineResult{request: req}, err
+	}
+	result := lineResult{status: resp.StatusCode, response: respBody, latency: time.Since(start), request: req}
+
+	// On 401, retry once with a refreshed Authorization header
+	if resp.StatusCode == http.StatusUnauthorized && exprs.reauth != nil {
+		req, err = reauthenticate(req, resp, respBody, exprs.reauth, env)
+		if err != nil {
+			return result, err
+		}
+		resp, respBody, err = sendWithRetries(client, req, prepareRetry)
+		if err != nil {
+			return lineResult{request: req}, err
+		}
+		result = lineResult{status: resp.StatusCode, response: respBody, latency: time.Since(start), request: req}
+	}
+
+	result.carried = carriedFrom(exprs.carry, resp)
+
+	// A line that has timed out has already been reported as failed
+	if ctx.Err() != nil {
+		return result, ctx.Err()
+	}
+
+	// Output response, unless --on-success replaces it or only errors are
+	// shown
+	showStatus := exprs.onSuccess == nil && !errorsOnly && !histogram
+	if showStatus {
+		err := writeOutputLine(exprs.output, map[string]interface{}{
+			"input":      input,
+			"url":        req.URL.String(),
+			"status":     resp.StatusCode,
+			"statusText": resp.Status,
+			"requestID":  requestID,
+			"response":   parseResponseBody(respBody),
+			"body":       truncateForLog(compactForLog(respBody)),
+			"latency":    result.latency,
+		})
+		if err != nil {
+			return result, err
+		}
+	}
+	if preflight {
+		var buf bytes.Buffer
+		fmt.Fprintf(&buf, "Response Headers:\n")
+		for name, values := range resp.Header {
+			for _, value := range values {
+				fmt.Fprintf(&buf, "  %s: %s\n", name, displayHeader(name, value))
+			}
+		}
+		output.Write(buf.Bytes())
+	}
+
+	if postResponse != "" {
+		if err := runPostResponse(postResponse, req, resp, respBody, input); err != nil {
+			if postResponseStrict && resp.StatusCode < 400 {
+				return result, err
+			}
+			fmt.Fprintf(os.Stderr, "Warning: %v\n", err)
+		}
+	}
+
+	if exprs.status != nil {
+		outcome, ok, err := classifyResponse(exprs.status, withResponse(env, resp.StatusCode, respBody))
+		if err != nil {
+			return result, err
+		}
+		result.outcome = outcome
+		if !ok {
+			return result, fmt.Errorf("status expression: %s (HTTP %s)", outcome, resp.Status)
+		}
+	} else if resp.StatusCode >= 400 {
+		return result, fmt.Errorf("HTTP error: %s", resp.Status)
+	}
+	result.succeeded = true
+
+	if exprs.onSuccess != nil {
+		if err := writeOnSuccess(exprs.onSuccess, withResponse(env, resp.StatusCode, respBody)); err != nil {
+			return result, err
+		}
+	}
+
+	return result, nil
+}
+
+// checkBodyType reports an error if the body isn't JSON of the type given
+// by --validate-json. A string sent verbatim is checked as encoded; other
+// bodies are checked by the type of the value being encoded.
+func checkBodyType(body interface{}, bodyBytes []byte, verbatim bool) error {
+	var kind string
+	if verbatim {
+		if !json.Valid(bodyBytes) {
+			return fmt.Errorf("body is not valid JSON")
+		}
+		switch bytes.TrimSpace(bodyBytes)[0] {
+		case '{':
+			kind = "object"
+		case '[':
+			kind = "array"
+		case '"':
+			kind = "string"
+		case 't', 'f':
+			kind = "boolean"
+		case 'n':
+			kind = "null"
+		default:
+			kind = "number"
+		}
+	} else {
+		kind = jsonKind(body)
+	}
+
+	if validateJSON != "any" && kind != validateJSON {
+		return fmt.Errorf("body is %s, expected %s", describeKind(kind), describeKind(validateJSON))
+	}
+	return nil
+}
+
+// jsonKind returns the kind of JSON value a value encodes as.
+func jsonKind(v interface{}) string {
+	if v == nil {
+		return "null"
+	}
+	if _, isBytes := v.([]byte); isBytes {
+		return "string"
+	}
+	if _, isBig := v.(*big.Int); isBig {
+		return "number"
+	}
+	switch reflect.TypeOf(v).Kind() {
+	case reflect.Map, reflect.Struct:
+		return "object"
+	case reflect.Slice, reflect.Array:
+		return "array"
+	case reflect.String:
+		return "string"
+	case reflect.Bool:
+		return "boolean"
+	case reflect.Pointer, reflect.Interface:
+		value := reflect.ValueOf(v)
+		if value.IsNil() {
+			return "null"
+		}
+		return jsonKind(value.Elem().Interface())
+	}
+	return "number"
+}
+
+// describeKind returns a JSON kind with its article for error messages.
+func describeKind(kind string) string {
+	switch kind {
+	case "null":
+		return kind
+	case "array", "object":
+		return "an " + kind
+	}
+	return "a " + kind
+}
+
+// compactForLog returns a JSON response body without insignificant
+// whitespace when --compact-output is set, so that it prints on one line.
+// Other bodies are returned unchanged.
+func compactForLog(body []byte) []byte {
+	if !compactOutput {
+		return body
+	}
+	var buf bytes.Buffer
+	if err := json.Compact(&buf, body); err != nil {
+		return body
+	}
+	return buf.Bytes()
+}
+
+// truncateForLog returns the response body for printing, cut to
+// --max-body-log-bytes without splitting a UTF-8 character.
+func truncateForLog(body []byte) string {
+	if maxBodyLogBytes <= 0 || len(body) <= maxBodyLogBytes {
+		return string(body)
+	}
+	n := maxBodyLogBytes
+	for n > 0 && !utf8.RuneStart(body[n]) {
+		n--
+	}
+	return string(body[:n]) + "…(truncated)"
+}
+
+// classifyResponse evaluates --status-expr for a response. A boolean says
+// whether the request succeeded, and a string names the outcome: "ok", in
+// any case, is a success and anything else a failure. The outcome is
+// "ok" or "failed" for a boolean.
+func classifyResponse(status *compiledExpression, env map[string]interface{}) (string, bool, error) {
+	value, err := status.evaluate(env)
+	if err != nil {
+		return "", false, fmt.Errorf("evaluating status expression: %w", err)
+	}
+	switch v := value.(type) {
+	case bool:
+		if v {
+			return "ok", true, nil
+		}
+		return "failed", false, nil
+	case string:
+		if v == "" {
+			return "", false, fmt.Errorf("status expression returned an empty string")
+		}
+		return v, strings.EqualFold(v, "ok"), nil
+	}
+	return "", false, fmt.Errorf("status expression must return a boolean or a string, got %T", value)
+}
+
+// writeOnSuccess writes the result of the on-success expression to the
+// output. Strings are written as-is, nil is skipped, and anything else is
+// written as JSON.
+func writeOnSuccess(onSuccess *compiledExpression, env map[string]interface{}) error {
+	value, err := onSuccess.evaluate(env)
+	if err != nil {
+		return fmt.Errorf("evaluating on-success expression: %w", err)
+	}
+
+	switch v := value.(type) {
+	case nil:
+		return nil
+	case string:
+		_, err = fmt.Fprintln(output, v)
+	default:
+		data, marshalErr := json.Marshal(v)
+		if marshalErr != nil {
+			return fmt.Errorf("marshaling on-success result: %w", marshalErr)
+		}
+		_, err = fmt.Fprintln(output, string(data))
+	}
+	return err
+}
+
+// framed returns body preceded by its length as a 4-byte big-endian
+// unsigned integer.
+func framed(body []byte) []byte {
+	frame := make([]byte, 4, 4+len(body))
+	binary.BigEndian.PutUint32(frame, uint32(len(body)))
+	return append(frame, body...)
+}
+
+// printRequest writes the method, URL, headers, and body of a request, with
+// sensitive header values redacted.
+func printRequest(w io.Writer, req *http.Request, requestID string, body []byte) {
+	fmt.Fprintf(w, "Method: %s\n", req.Method)
+	fmt.Fprintf(w, "URL: %s\n", req.URL)
+	if requestID != "" {
+		fmt.Fprintf(w, "Request ID: %s\n", requestID)
+	}
+	fmt.Fprintf(w, "Headers:\n")
+	for name, values := range req.Header {
+		for _, value := range values {
+			fmt.Fprintf(w, "  %s: %s\n", name, displayHeader(name, value))
+		}
+	}
+	fmt.Fprintf(w, "Body: %s\n", string(body))
+}
+
+// setHeaders evaluates header expressions against env and sets the
+// resulting headers on header.
+func setHeaders(header http.Header, headers []*compiledExpression, env map[string]interface{}) error {
+	for _, expression := range headers {
+		headerValue, err := expression.evaluate(env)
+		if err != nil {
+			return fmt.Errorf("evaluating header expression: %w", err)
+		}
+
+		// A header that evaluates to nil or an empty string is omitted
+		if headerValue == nil || headerValue == "" {
+			continue
+		}
+
+		// Parse header string (format: "Header-Name: Value")
+		headerStr := fmt.Sprintf("%v", headerValue)
+		parts := strings.SplitN(headerStr, ":", 2)
+		if len(parts) != 2 {
+			return fmt.Errorf("invalid header format: %s", headerStr)
+		}
+		setHeader(header, strings.TrimSpace(parts[0]), strings.TrimSpace(parts[1]))
+	}
+	return nil
+}
+
+// setHeader sets a request header. With --raw-headers, the name is sent
+// exactly as given instead of in canonical form.
+func setHeader(header http.Header, name, value string) {
+	if !rawHeaders {
+		header.Set(name, value)
+		return
+	}
+	header.Del(name)
+	header[name] = []string{value}
+}
+
+// encodeJSONStream returns a reader that streams the JSON encoding of v
+// without buffering the whole document. Encoding starts on the first read,
+// so a request that's never sent leaves nothing running.
+func encodeJSONStream(v interface{}) io.ReadCloser {
+	return &jsonStream{value: v}
+}
+
+// jsonStream is the request body returned by encodeJSONStream.
+type jsonStream struct {
+	value  interface{}
+	mu     sync.Mutex
+	pr     *io.PipeReader
+	closed bool
+}
+
+func (s *jsonStream) Read(p []byte) (int, error) {
+	s.mu.Lock()
+	if s.closed {
+		s.mu.Unlock()
+		return 0, io.ErrClosedPipe
+	}
+	if s.pr == nil {
+		pr, pw := io.Pipe()
+		go func() {
+			pw.CloseWithError(json.NewEncoder(pw).Encode(s.value))
+		}()
+		s.pr = pr
+	}
+	pr := s.pr
+	s.mu.Unlock()
+	return pr.Read(p)
+}
+
+// Close stops the encoding if it has started.
+func (s *jsonStream) Close() error {
+	s.mu.Lock()
+	s.closed = true
+	pr := s.pr
+	s.mu.Unlock()
+	if pr == nil {
+		return nil
+	}
+	return pr.Close()
+}
+
+// timeoutFor returns the --timeout for a request with a body of size
+// bytes, extended by --timeout-per-kb. Streamed bodies of unknown size get
+// the base timeout.
+func timeoutFor(size int64) time.Duration {
+	if size <= 0 {
+		return requestTimeout
+	}
+	return requestTimeout + time.Duration(float64(timeoutPerKB)*float64(size)/1024)
+}
+
+// requestCount is the number of requests sent across the run.
+var requestCount atomic.Int64
+
+// errRequestLimit is returned instead of sending a request once
+// --max-requests have been sent.
+var errRequestLimit = errors.New("request limit reached")
+
+// requestLimitReached reports whether --max-requests have been sent.
+func requestLimitReached() bool {
+	return maxRequests > 0 && requestCount.Load() >= maxRequests
+}
+
+// sendRequest sends req and reads the full response body.
+func sendRequest(client *http.Client, req *http.Request) (*http.Response, []byte, error) {
+	// Nothing is sent for a line that has already timed out
+	if err := req.Context().Err(); err != nil {
+		return nil, nil, fmt.Errorf("sending request: %w", err)
+	}
+	if requestCount.Add(1) > maxRequests && maxRequests > 0 {
+		requestCount.Add(-1)
+		return nil, nil, fmt.Errorf("not sending request: %w (%d)", errRequestLimit, maxRequests)
+	}
+
+	if limiter != nil {
+		if err := limiter.wait(req.Context()); err != nil {
+			return nil, nil, fmt.Errorf("sending request: %w", err)
+		}
+	}
+
+	parent := req.Context()
+	timeout := timeoutFor(req.ContentLength)
+	if requestTimeout > 0 {
+		ctx, cancel := context.WithTimeout(parent, timeout)
+		defer cancel()
+		req = req.WithContext(ctx)
+	}
+	timedOut := func() bool {
+		return requestTimeout > 0 && req.Context().Err() == context.DeadlineExceeded && parent.Err() == nil
+	}
+
+	var trace *requestTrace
+	if traceRequests {
+		req, trace = withTrace(req)
+	}
+
+	resp, err := client.Do(req)
+	if err != nil && timedOut() {
+		return nil, nil, fmt.Errorf("sending request: timed out after %s", timeout)
+	} else if err != nil {
+		return nil, nil, fmt.Errorf("sending request: %w", err)
+	}
+	defer resp.Body.Close()
+
+	body, err := io.ReadAll(resp.Body)
+	if err != nil && timedOut() {
+		return nil, nil, fmt.Errorf("reading response: timed out after %s", timeout)
+	} else if err != nil {
+		return nil, nil, fmt.Errorf("reading response: %w", err)
+	}
+	body, err = decodeResponse(resp, body)
+	if err != nil {
+		return nil, nil, fmt.Errorf("reading response: %w", err)
+	}
+
+	if trace != nil {
+		trace.report(os.Stderr, req)
+	}
+	if limiter != nil && limiter.observe(resp.StatusCode) {
+		fmt.Fprintf(os.Stderr, "Slowing to %.2f requests/s after %s\n", limiter.currentRate(), resp.Status)
+	}
+	return resp, body, nil
+}
+
+// reauthenticate evaluates the reauth expression against a 401 response and
+// returns a copy of req carrying the new Authorization header.
+func reauthenticate(req *http.Request, resp *http.Response, respBody []byte, reauth *compiledExpression, env map[string]interface{}) (*http.Request, error) {
+	auth, err := reauth.evaluate(withResponse(env, resp.StatusCode, respBody))
+	if err != nil {
+		return nil, fmt.Errorf("evaluating reauth expression: %w", err)
+	}
+	if auth == nil || auth == "" {
+		return nil, fmt.Errorf("HTTP error: %s (reauth expression returned no Authorization value)", resp.Status)
+	}
+
+	retry, err := rewindRequest(req)
+	if err != nil {
+		return nil, err
+	}
+	retry.Header.Set("Authorization", fmt.Sprintf("%v", auth))
+	return retry, nil
+}
+
+// newEnv returns the expression environment for an input.
+func newEnv(input interface{}) map[string]interface{} {
+	env := map[string]interface{}{
+		"input":     input,
+		"env":       getEnvMap(),
+		"bootstrap": bootstrapValue,
+		"vars":      varsValue,
+	}
+	if metaField != "" {
+		env["meta"] = lineMeta(input)
+	}
+	return env
+}
+
+// lineMeta returns the --meta-field of input, or an empty object if the
+// input doesn't have one.
+func lineMeta(input interface{}) interface{} {
+	if meta, found := lookupPath(input, metaField); found && meta != nil {
+		return meta
+	}
+	return map[string]interface{}{}
+}
+
+// inputEnvs returns the expression environments for an input. With
+// --explode-fields, an object yields one environment per top-level field,
+// in key order, with the field exposed as key and value.
+func inputEnvs(input interface{}) []map[string]interface{} {
+	fields, isObject := input.(map[string]interface{})
+	if !explodeFields || !isObject {
+		return []map[string]interface{}{newEnv(input)}
+	}
+
+	envs := make([]map[string]interface{}, 0, len(fields))
+	for _, key := range sortedKeys(fields) {
+		env := newEnv(input)
+		env["key"] = key
+		env["value"] = fields[key]
+		envs = append(envs, env)
+	}
+	return envs
+}
+
+// withResponse returns a copy of env with the response body and status
+// added, for expressions evaluated against a response.
+func withResponse(env map[string]interface{}, status int, body []byte) map[string]interface{} {
+	responseEnv := map[string]interface{}{
+		"response": parseResponseBody(body),
+		"status":   status,
+	}
+	for k, v := range env {
+		responseEnv[k] = v
+	}
+	return responseEnv
+}
+
+// parseResponseBody returns the response body parsed as JSON, or as a
+// string if it isn't valid JSON.
+func parseResponseBody(body []byte) interface{} {
+	var parsed interface{}
+	if err := json.Unmarshal(body, &parsed); err != nil {
+		return string(body)
+	}
+	return parsed
+}
+
+// statusRange is an inclusive range of HTTP status codes.
+type statusRange struct {
+	min, max int
+}
+
+type statusRanges []statusRange
+
+// parseStatusRanges parses status codes and ranges like "401" or "500-599".
+func parseStatusRanges(specs []string) (statusRanges, error) {
+	var ranges statusRanges
+	for _, spec := range specs {
+		spec = strings.TrimSpace(spec)
+		lo, hi, isRange := strings.Cut(spec, "-")
+		min, err := strconv.Atoi(strings.TrimSpace(lo))
+		if err != nil {
+			return nil, fmt.Errorf("invalid status %q", spec)
+		}
+		max := min
+		if isRange {
+			max, err = strconv.Atoi(strings.TrimSpace(hi))
+			if err != nil || max < min {
+				return nil, fmt.Errorf("invalid status range %q", spec)
+			}
+		}
+		ranges = append(ranges, statusRange{min: min, max: max})
+	}
+	return ranges, nil
+}
+
+func (r statusRanges) contains(status int) bool {
+	for _, sr := range r {
+		if status >= sr.min && status <= sr.max {
+			return true
+		}
+	}
+	return false
+}
+
+// exprEnv describes the variables available to expressions.
+var exprEnv = types.Map{
+	"input":     types.Any,
+	"env":       types.TypeOf(map[string]string{}),
+	"key":       types.String,
+	"value":     types.Any,
+	"prev":      types.Any,
+	"attempt":   types.Int,
+	"source":    types.String,
+	"bootstrap": types.Any,
+	"vars":      types.Any,
+	"meta":      types.Any,
+}
+
+// responseExprEnv describes the variables available to expressions
+// evaluated against a response.
+var responseExprEnv = types.Map{
+	"input":     types.Any,
+	"env":       types.TypeOf(map[string]string{}),
+	"key":       types.String,
+	"value":     types.Any,
+	"prev":      types.Any,
+	"attempt":   types.Int,
+	"source":    types.String,
+	"bootstrap": types.Any,
+	"vars":      types.Any,
+	"meta":      types.Any,
+	"response":  types.Any,
+	"status":    types.Int,
+}
+
+// deadLetterExprEnv describes the variables available to a dead-letter
+// format expression.
+var deadLetterExprEnv = types.Map{
+	"input":     types.Any,
+	"env":       types.TypeOf(map[string]string{}),
+	"key":       types.String,
+	"value":     types.Any,
+	"prev":      types.Any,
+	"attempt":   types.Int,
+	"source":    types.String,
+	"bootstrap": types.Any,
+	"vars":      types.Any,
+	"meta":      types.Any,
+	"response":  types.Any,
+	"status":    types.Int,
+	"error":     types.String,
+}
+
+// constantVariables are the expression variables that don't change from
+// line to line.
+var constantVariables = map[string]bool{
+	"env":       true,
+	"bootstrap": true,
+	"vars":      true,
+}
+
+// compiledExpression is an expression compiled once and evaluated for each
+// line. Expressions that don't reference any per-line variables are
+// evaluated once and the result reused.
+type compiledExpression struct {
+	program    *vm.Program
+	constant   bool
+	perAttempt bool     // references attempt
+	envKeys    []string // environment variables referenced as env.NAME
+
+	once  sync.Once // evaluates a constant expression
+	value interface{}
+	err   error
+}
+
+func compileExpression(expression string, env types.Map) (*compiledExpression, error) {
+	options := append([]expr.Option{expr.Env(env)}, exprFunctions...)
+	program, err := expr.Compile(expression, options...)
+	if err != nil {
+		return nil, err
+	}
+
+	node := program.Node()
+	v := &referenceVisitor{constant: true}
+	ast.Walk(&node, v)
+
+	return &compiledExpression{program: program, constant: v.constant, perAttempt: v.perAttempt, envKeys: v.envKeys}, nil
+}
+
+func (c *compiledExpression) evaluate(env map[string]interface{}) (interface{}, error) {
+	if !c.constant {
+		return expr.Run(c.program, env)
+	}
+	c.once.Do(func() {
+		c.value, c.err = expr.Run(c.program, env)
+	})
+	return c.value, c.err
+}
+
+// referenceVisitor determines whether an expression's result is the same
+// for every line, whether it depends on the attempt, and which environment
+// variables it references.
+type referenceVisitor struct {
+	constant   bool
+	perAttempt bool
+	envKeys    []string
+}
+
+func (v *referenceVisitor) Visit(node *ast.Node) {
+	switch n := (*node).(type) {
+	case *ast.IdentifierNode:
+		if !constantVariables[n.Value] {
+			v.constant = false
+		}
+		if n.Value == "attempt" {
+			v.perAttempt = true
+		}
+	case *ast.BuiltinNode:
+		if n.Name == "now" {
+			v.constant = false
+		}
+	case *ast.MemberNode:
+		id, isIdent := n.Node.(*ast.IdentifierNode)
+		key, isString := n.Property.(*ast.StringNode)
+		if isIdent && isString && id.Value == "env" {
+			v.envKeys = append(v.envKeys, key.Value)
+		}
+	}
+}
+
+func getEnvMap() map[string]string {
+	envMap := make(map[string]string)
+	for _, e := range os.Environ() {
+		pair := strings.SplitN(e, "=", 2)
+		if len(pair) == 2 {
+			envMap[pair[0]] = pair[1]
+		}
+	}
+	return envMap
+}
+
+// newUUID returns a random (version 4) UUID string.
+func newUUID() (string, error) {
+	var b [16]byte
+	if _, err := rand.Read(b[:]); err != nil {
+		return "", err
+	}
+	b[6] = (b[6] & 0x0f) | 0x40
+	b[8] = (b[8] & 0x3f) | 0x80
+	return fmt.Sprintf("%x-%x-%x-%x-%x", b[0:4], b[4:6], b[6:8], b[8:10], b[10:16]), nil
 }
@@ -0,0 +1,49 @@
+package main
+
+import (
+	"errors"
+	"os"
+	"os/exec"
+	"testing"
+	"time"
+)
+
+// TestMain runs the command itself when re-executed by a test, so tests can
+// check how the process exits
+func TestMain(m *testing.M) {
+	if os.Getenv("PUB_TEST_RUN_MAIN") == "1" {
+		main()
+		os.Exit(0)
+	}
+	os.Exit(m.Run())
+}
+
+func TestDeadlineWithStalledStdin(t *testing.T) {
+	stdin, stall, err := os.Pipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer stdin.Close()
+	defer stall.Close()
+
+	cmd := exec.Command(os.Args[0], "--deadline", "500ms", "http://127.0.0.1:1/")
+	cmd.Env = append(os.Environ(), "PUB_TEST_RUN_MAIN=1")
+	cmd.Stdin = stdin
+	start := time.Now()
+	if err := cmd.Start(); err != nil {
+		t.Fatal(err)
+	}
+	// Don't let a deadline that never fires hang the test
+	kill := time.AfterFunc(10*time.Second, func() { cmd.Process.Kill() })
+	defer kill.Stop()
+	err = cmd.Wait()
+	elapsed := time.Since(start)
+
+	var exitErr *exec.ExitError
+	if !errors.As(err, &exitErr) || exitErr.ExitCode() != 1 {
+		t.Fatalf("expected exit status 1, got %v", err)
+	}
+	if elapsed > 3*time.Second {
+		t.Fatalf("deadline of 500ms took %s to stop a stalled stdin", elapsed)
+	}
+}
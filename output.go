@@ -0,0 +1,114 @@
+package main
+
+import (
+	"bytes"
+	"io"
+	"os"
+	"sync"
+	"time"
+)
+
+// lockedWriter serializes writes to an underlying writer, so that lines
+// written from different goroutines aren't interleaved.
+type lockedWriter struct {
+	mu sync.Mutex
+	w  io.Writer
+}
+
+func (l *lockedWriter) Write(p []byte) (int, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.w.Write(p)
+}
+
+// recordFile appends records to a file, buffering them so that they're
+// written every flushEvery records and, if flushInterval is set, at least
+// that often. Records are always written whole, several to a write.
+type recordFile struct {
+	mu      sync.Mutex
+	file    *os.File
+	buf     bytes.Buffer
+	pending int
+	err     error // from a flush in the background
+	stop    chan struct{}
+}
+
+// openRecordFile opens path for appending records.
+func openRecordFile(path string) (*recordFile, error) {
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644)
+	if err != nil {
+		return nil, err
+	}
+	r := &recordFile{file: f, stop: make(chan struct{})}
+	if flushInterval > 0 {
+		go r.flushPeriodically(flushInterval)
+	}
+	return r, nil
+}
+
+// write adds a record, which should end in a newline.
+func (r *recordFile) write(record []byte) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.err != nil {
+		err := r.err
+		r.err = nil
+		return err
+	}
+	r.buf.Write(record)
+	r.pending++
+	if r.pending >= flushEvery {
+		return r.flushLocked()
+	}
+	return nil
+}
+
+func (r *recordFile) flushPeriodically(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			r.mu.Lock()
+			if err := r.flushLocked(); err != nil {
+				r.err = err
+			}
+			r.mu.Unlock()
+		case <-r.stop:
+			return
+		}
+	}
+}
+
+// Flush writes any buffered records, returning the error from a flush in
+// the background that hasn't been reported by a write.
+func (r *recordFile) Flush() error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	err := r.flushLocked()
+	if r.err != nil {
+		err = r.err
+		r.err = nil
+	}
+	return err
+}
+
+func (r *recordFile) flushLocked() error {
+	r.pending = 0
+	if r.buf.Len() == 0 {
+		return nil
+	}
+	_, err := r.file.Write(r.buf.Bytes())
+	r.buf.Reset()
+	return err
+}
+
+// Close writes any buffered records and closes the file.
+func (r *recordFile) Close() error {
+	close(r.stop)
+	err := r.Flush()
+	if closeErr := r.file.Close(); err == nil {
+		err = closeErr
+	}
+	return err
+}
@@ -0,0 +1,186 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"math/big"
+	"math/rand"
+	"os"
+	"strings"
+	"time"
+)
+
+// parsedLine is a line of input and the result of parsing it.
+type parsedLine struct {
+	line   string
+	source string
+	input  interface{}
+	err    error
+}
+
+// parseLines reads non-blank lines from scanner and parses them as JSON
+// using workers goroutines, delivering them in input order, each with the
+// name of its input from source. The returned function reports any read
+// error once the channel is closed.
+//
+// Reading is bounded by the consumer: pending holds at most workers lines
+// awaiting delivery and the output channel is unbuffered, so no more than
+// about workers+2 lines are held in memory while a slow request is in
+// flight, and reading blocks until the consumer catches up.
+func parseLines(scanner *bufio.Scanner, workers int, source func() string) (<-chan parsedLine, func() error) {
+	type job struct {
+		line   string
+		source string
+		result chan parsedLine
+	}
+
+	// Each line is queued on pending before jobs, so pending's depth is
+	// what limits how far reading gets ahead of the consumer
+	jobs := make(chan job, workers)
+	pending := make(chan chan parsedLine, workers)
+	out := make(chan parsedLine)
+
+	var readErr error
+	go func() {
+		defer close(jobs)
+		defer close(pending)
+		for scanner.Scan() {
+			// Lines from Windows tools end in \r\n. A carriage return can't
+			// appear unescaped inside a JSON string, so only the line ending
+			// is removed
+			line := strings.TrimSuffix(scanner.Text(), "\r")
+			if strings.TrimSpace(line) == "" {
+				continue
+			}
+			result := make(chan parsedLine, 1)
+			pending <- result
+			jobs <- job{line: line, source: source(), result: result}
+		}
+		readErr = scanner.Err()
+	}()
+
+	for i := 0; i < workers; i++ {
+		go func() {
+			for j := range jobs {
+				input, err := parseLine(j.line)
+				j.result <- parsedLine{line: j.line, source: j.source, input: input, err: err}
+			}
+		}()
+	}
+
+	// Deliver results in the order the lines were read
+	go func() {
+		defer close(out)
+		for result := range pending {
+			out <- <-result
+		}
+	}()
+
+	return out, func() error { return readErr }
+}
+
+// parsePrecise parses a line of JSON like parseLine, but without losing
+// the precision of integers: those that fit in an int become ints, larger
+// ones become *big.Int, and only other numbers become float64.
+func parsePrecise(line string) (interface{}, error) {
+	decoder := json.NewDecoder(strings.NewReader(line))
+	decoder.UseNumber()
+	var input interface{}
+	if err := decoder.Decode(&input); err != nil {
+		return nil, fmt.Errorf("parsing JSON: %w", err)
+	}
+	if _, err := decoder.Token(); err != io.EOF {
+		return nil, fmt.Errorf("parsing JSON: invalid data after top-level value")
+	}
+	return preciseNumbers(input), nil
+}
+
+// preciseNumbers replaces the json.Number values within v with ints,
+// *big.Ints, or float64s.
+func preciseNumbers(v interface{}) interface{} {
+	switch v := v.(type) {
+	case map[string]interface{}:
+		for key, value := range v {
+			v[key] = preciseNumbers(value)
+		}
+	case []interface{}:
+		for i, value := range v {
+			v[i] = preciseNumbers(value)
+		}
+	case json.Number:
+		if n, err := v.Int64(); err == nil && int64(int(n)) == n {
+			return int(n)
+		}
+		if n, ok := new(big.Int).SetString(v.String(), 10); ok {
+			return n
+		}
+		f, _ := v.Float64()
+		return f
+	}
+	return v
+}
+
+// untilIdle forwards lines from in until it's closed or no line arrives
+// within timeout of the last one being taken. The returned function
+// reports whether the output was closed because the input went idle.
+func untilIdle(in <-chan parsedLine, timeout time.Duration) (<-chan parsedLine, func() bool) {
+	out := make(chan parsedLine)
+	var idle bool
+	go func() {
+		defer close(out)
+		timer := time.NewTimer(timeout)
+		defer timer.Stop()
+		for {
+			select {
+			case p, ok := <-in:
+				if !ok {
+					return
+				}
+				out <- p
+				// The timer may have fired while the line was waiting
+				// to be taken, so clear it before starting over
+				if !timer.Stop() {
+					select {
+					case <-timer.C:
+					default:
+					}
+				}
+				timer.Reset(timeout)
+			case <-timer.C:
+				idle = true
+				return
+			}
+		}
+	}()
+	return out, func() bool { return idle }
+}
+
+// shuffled reads every line from in and then delivers them in the order
+// of a random permutation from rng. If limit is positive and the lines
+// read add up to more than limit bytes, it exits with an error before
+// delivering any.
+func shuffled(in <-chan parsedLine, rng *rand.Rand, limit int64) <-chan parsedLine {
+	out := make(chan parsedLine)
+	go func() {
+		defer close(out)
+		var lines []parsedLine
+		var size int64
+		for p := range in {
+			size += int64(len(p.line))
+			if limit > 0 && size > limit {
+				fmt.Fprintf(os.Stderr, "Error: --shuffle: input is larger than --max-memory of %s; no requests were sent\n", maxMemory)
+				os.Exit(1)
+			}
+			lines = append(lines, p)
+		}
+		rng.Shuffle(len(lines), func(i, j int) {
+			lines[i], lines[j] = lines[j], lines[i]
+		})
+		for _, p := range lines {
+			out <- p
+		}
+	}()
+	return out
+}
@@ -0,0 +1,104 @@
+package main
+
+import (
+	"context"
+	"math"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// rampStartFraction is the fraction of the target rate used at the start
+// of a ramp.
+const rampStartFraction = 0.1
+
+// rateLimiter spaces requests to a target rate, optionally ramping up
+// linearly from a fraction of the rate over a warmup period.
+type rateLimiter struct {
+	rate float64 // requests per second
+	ramp time.Duration
+
+	// With --adaptive-rate, rate moves between minAdaptiveRate and max
+	// as responses are observed
+	adaptive bool
+	max      float64
+
+	// mu guards the fields below and rate, since a line abandoned by
+	// --line-timeout may still be waiting
+	mu    sync.Mutex
+	start time.Time
+	next  time.Time
+}
+
+func newRateLimiter(rate float64, ramp time.Duration) *rateLimiter {
+	return &rateLimiter{rate: rate, ramp: ramp, max: rate}
+}
+
+// minAdaptiveRate is the lowest rate, in requests per second, that
+// --adaptive-rate slows down to.
+const minAdaptiveRate = 0.1
+
+// observe adjusts an adaptive rate for a response: a 429 or 503 multiplies
+// it by --rate-decrease, and other responses below 400 raise it so that
+// sustained success adds --rate-increase requests per second each second,
+// up to --rate. It reports whether the rate was lowered.
+func (l *rateLimiter) observe(status int) bool {
+	if !l.adaptive {
+		return false
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	switch {
+	case status == http.StatusTooManyRequests || status == http.StatusServiceUnavailable:
+		l.rate = math.Max(l.rate*rateDecrease, minAdaptiveRate)
+		return true
+	case status < 400:
+		l.rate = math.Min(l.rate+rateIncrease/l.rate, l.max)
+	}
+	return false
+}
+
+// current returns the effective rate at now.
+func (l *rateLimiter) current(now time.Time) float64 {
+	elapsed := now.Sub(l.start)
+	if l.ramp <= 0 || elapsed >= l.ramp {
+		return l.rate
+	}
+	min := l.rate * rampStartFraction
+	return min + (l.rate-min)*float64(elapsed)/float64(l.ramp)
+}
+
+// currentRate returns the rate requests are being sent at.
+func (l *rateLimiter) currentRate() float64 {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.rate
+}
+
+// wait blocks until the next request may be sent or ctx is done. The
+// request's time is reserved before waiting for it.
+func (l *rateLimiter) wait(ctx context.Context) error {
+	l.mu.Lock()
+	now := time.Now()
+	if l.start.IsZero() {
+		l.start = now
+		l.next = now
+	}
+	at := now
+	if l.next.After(now) {
+		at = l.next
+	}
+	l.next = at.Add(time.Duration(float64(time.Second) / l.current(at)))
+	l.mu.Unlock()
+
+	if d := time.Until(at); d > 0 {
+		timer := time.NewTimer(d)
+		defer timer.Stop()
+		select {
+		case <-timer.C:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+	return nil
+}
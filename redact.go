@@ -0,0 +1,25 @@
+package main
+
+import (
+	"path"
+	"strings"
+)
+
+// sensitiveHeaders are always redacted from diagnostic output.
+var sensitiveHeaders = []string{"Authorization", "Proxy-Authorization", "Cookie", "Set-Cookie"}
+
+// redactedValue is shown in place of a sensitive header's value.
+const redactedValue = "***"
+
+// displayHeader returns the value of a header as it should be shown in
+// diagnostic output: redacted if its name is one of sensitiveHeaders or
+// matches a --redact-headers pattern. Patterns are case-insensitive globs,
+// like X-Api-Key or *-Token.
+func displayHeader(name, value string) string {
+	for _, pattern := range append(sensitiveHeaders, redactHeaders...) {
+		if matched, _ := path.Match(strings.ToLower(pattern), strings.ToLower(name)); matched {
+			return redactedValue
+		}
+	}
+	return value
+}
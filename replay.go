@@ -0,0 +1,48 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"io"
+	"os"
+)
+
+// openReplay returns a reader over the original input lines recorded in a
+// dead-letter file. Records written with --dead-letter-format json are
+// unwrapped to their input; any other line, such as one written in the raw
+// format, is replayed as-is.
+func openReplay(path string) (io.ReadCloser, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+
+	r, w := io.Pipe()
+	go func() {
+		defer file.Close()
+		scanner := bufio.NewScanner(file)
+		for scanner.Scan() {
+			if _, err := io.WriteString(w, replayedLine(scanner.Text())+"\n"); err != nil {
+				return
+			}
+		}
+		w.CloseWithError(scanner.Err())
+	}()
+	return r, nil
+}
+
+// replayedLine returns the input recorded in a line of a dead-letter file.
+func replayedLine(line string) string {
+	var record struct {
+		Timestamp *string         `json:"timestamp"`
+		Error     *string         `json:"error"`
+		Input     json.RawMessage `json:"input"`
+	}
+	if err := json.Unmarshal([]byte(line), &record); err != nil {
+		return line
+	}
+	if record.Timestamp == nil || record.Error == nil || record.Input == nil {
+		return line
+	}
+	return string(record.Input)
+}
@@ -0,0 +1,156 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// retryBudget caps the total number of retries across the whole run.
+type retryBudget struct {
+	limit     int64
+	used      atomic.Int64
+	exhausted atomic.Bool
+}
+
+// take reserves one retry, reporting false once the budget is exhausted.
+func (b *retryBudget) take() bool {
+	if b.used.Add(1) > b.limit {
+		b.used.Add(-1)
+		return false
+	}
+	return true
+}
+
+// budget is shared by all lines when --retry-budget is set.
+var budget *retryBudget
+
+// retryCount is the number of retries made across the run.
+var retryCount atomic.Int64
+
+// sendWithRetries sends req, retrying transport errors, 429s, and 5xx
+// responses up to --retries times with exponential backoff, or after the
+// delay given by a response's Retry-After header if it's no longer than
+// --retry-after-max. If prepare is
+// non-nil, it's called with the attempt number before each retry is sent.
+func sendWithRetries(client *http.Client, req *http.Request, prepare func(*http.Request, int) error) (*http.Response, []byte, error) {
+	delay := retryDelay
+	for attempt := 1; ; attempt++ {
+		resp, body, err := sendRequest(client, req)
+		if attempt > retries || !retryable(resp, err) || req.Context().Err() != nil || requestLimitReached() {
+			return resp, body, err
+		}
+		if retryIdempotentOnly && !idempotent(req) {
+			return resp, body, err
+		}
+		if budget != nil && !budget.take() {
+			if !budget.exhausted.Swap(true) {
+				fmt.Fprintf(os.Stderr, "Retry budget of %d exhausted; failures will no longer be retried\n", budget.limit)
+			}
+			return resp, body, err
+		}
+		retryCount.Add(1)
+
+		reason := ""
+		if err != nil {
+			reason = err.Error()
+		} else {
+			reason = resp.Status
+		}
+		wait := delay
+		if after, ok := retryAfter(resp, time.Now()); ok {
+			if after <= retryAfterMax {
+				wait = after
+			} else {
+				reason += fmt.Sprintf(" (ignoring Retry-After of %s, over --retry-after-max)", after)
+			}
+		}
+		fmt.Fprintf(os.Stderr, "Retrying (%d/%d) in %s: %s\n", attempt, retries, wait, reason)
+
+		timer := time.NewTimer(wait)
+		select {
+		case <-timer.C:
+		case <-req.Context().Done():
+			timer.Stop()
+			return resp, body, err
+		}
+		delay *= 2
+
+		req, err = rewindRequest(req)
+		if err != nil {
+			return nil, nil, err
+		}
+		if prepare != nil {
+			if err := prepare(req, attempt); err != nil {
+				return nil, nil, err
+			}
+		}
+	}
+}
+
+// idempotencyKeyHeaders mark a request as safe to retry whatever its method.
+var idempotencyKeyHeaders = []string{"Idempotency-Key", "X-Idempotency-Key"}
+
+// idempotent reports whether req can be sent again without side effects
+// beyond those of sending it once: its method is idempotent, or it carries
+// an idempotency key for the server to deduplicate on.
+func idempotent(req *http.Request) bool {
+	switch req.Method {
+	case http.MethodGet, http.MethodHead, http.MethodPut, http.MethodDelete, http.MethodOptions:
+		return true
+	}
+	for _, name := range idempotencyKeyHeaders {
+		if req.Header.Get(name) != "" {
+			return true
+		}
+	}
+	return false
+}
+
+// retryable reports whether a request should be retried after receiving
+// resp or err.
+func retryable(resp *http.Response, err error) bool {
+	if err != nil {
+		return true
+	}
+	return resp.StatusCode == http.StatusTooManyRequests || resp.StatusCode >= 500
+}
+
+// retryAfter returns the delay requested by resp's Retry-After header,
+// given in seconds or as an HTTP date, reporting false if there isn't one.
+func retryAfter(resp *http.Response, now time.Time) (time.Duration, bool) {
+	if resp == nil {
+		return 0, false
+	}
+	value := strings.TrimSpace(resp.Header.Get("Retry-After"))
+	if value == "" {
+		return 0, false
+	}
+	if seconds, err := strconv.Atoi(value); err == nil && seconds >= 0 {
+		return time.Duration(seconds) * time.Second, true
+	}
+	if date, err := http.ParseTime(value); err == nil {
+		if wait := date.Sub(now); wait > 0 {
+			return wait, true
+		}
+		return 0, true
+	}
+	return 0, false
+}
+
+// rewindRequest returns a copy of req that can be sent again.
+func rewindRequest(req *http.Request) (*http.Request, error) {
+	retry := req.Clone(req.Context())
+	if req.GetBody != nil {
+		body, err := req.GetBody()
+		if err != nil {
+			return nil, fmt.Errorf("rewinding request body: %w", err)
+		}
+		retry.Body = body
+	}
+	return retry, nil
+}
@@ -0,0 +1,197 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"sort"
+	"strconv"
+	"time"
+)
+
+// runStats accumulates the outcome of every line for the run summary.
+type runStats struct {
+	start     time.Time
+	processed int // input lines read, including those that failed to parse
+	ok        int
+	failed    int
+	skipped   int // lines that produced no requests
+	statuses  map[int]int
+	outcomes  map[string]int // classes from --status-expr
+	failures  map[string]int // failed lines by failureCategory
+	latencies []time.Duration
+}
+
+func newRunStats() *runStats {
+	return &runStats{start: time.Now(), statuses: make(map[int]int), outcomes: make(map[string]int), failures: make(map[string]int)}
+}
+
+// record counts the outcome of one request.
+func (s *runStats) record(result lineResult, err error) {
+	if err != nil {
+		s.failed++
+		s.failures[failureCategory(result)]++
+	} else {
+		s.ok++
+	}
+	if result.status != 0 {
+		s.statuses[result.status]++
+		s.latencies = append(s.latencies, result.latency)
+	}
+	if result.outcome != "" {
+		s.outcomes[result.outcome]++
+	}
+}
+
+// parseError counts a line that wasn't valid JSON.
+func (s *runStats) parseError() {
+	s.failed++
+	s.failures["invalid JSON"]++
+}
+
+// failureCategory names the kind of failure a failed request's result
+// shows, for --histogram.
+func failureCategory(result lineResult) string {
+	switch {
+	case result.outcome != "":
+		return "status expression"
+	case result.status >= 400:
+		return "HTTP error"
+	case result.status != 0:
+		return "failed after response"
+	case result.request != nil:
+		return "no response"
+	}
+	return "not sent"
+}
+
+// writeHistogram prints how many responses had each status code, with
+// their share of all responses, and how many lines failed in each way.
+func writeHistogram(w io.Writer, s *runStats) error {
+	responses := 0
+	statuses := make([]int, 0, len(s.statuses))
+	for status, n := range s.statuses {
+		statuses = append(statuses, status)
+		responses += n
+	}
+	sort.Ints(statuses)
+	categories := make([]string, 0, len(s.failures))
+	for category := range s.failures {
+		categories = append(categories, category)
+	}
+	sort.Strings(categories)
+
+	// Line up the counts of both tables
+	labels := make(map[int]string, len(statuses))
+	width, countWidth := 0, len(strconv.Itoa(max(responses, s.failed)))
+	for _, status := range statuses {
+		labels[status] = fmt.Sprintf("%d %s", status, http.StatusText(status))
+		width = max(width, len(labels[status]))
+	}
+	for _, category := range categories {
+		width = max(width, len(category))
+	}
+
+	var buf bytes.Buffer
+	fmt.Fprintf(&buf, "Responses: %d\n", responses)
+	for _, status := range statuses {
+		n := s.statuses[status]
+		fmt.Fprintf(&buf, "  %-*s  %*d  %5.1f%%\n", width, labels[status], countWidth, n, 100*float64(n)/float64(responses))
+	}
+	fmt.Fprintf(&buf, "Failures: %d\n", s.failed)
+	for _, category := range categories {
+		fmt.Fprintf(&buf, "  %-*s  %*d\n", width, category, countWidth, s.failures[category])
+	}
+	_, err := w.Write(buf.Bytes())
+	return err
+}
+
+// runSummary is the machine-readable summary written by --summary-json.
+type runSummary struct {
+	Processed          int                `json:"processed"`
+	OK                 int                `json:"ok"`
+	Failed             int                `json:"failed"`
+	Skipped            int                `json:"skipped"`
+	Retries            int64              `json:"retries"`
+	ElapsedMS          int64              `json:"elapsed_ms"`
+	StatusCounts       map[string]int     `json:"status_counts"`
+	LatencyPercentiles latencyPercentiles `json:"latency_percentiles"`
+	OutcomeCounts      map[string]int     `json:"outcome_counts,omitempty"`
+	InputLimitReached  bool               `json:"input_limit_reached,omitempty"`
+}
+
+// latencyPercentiles are response latencies in milliseconds.
+type latencyPercentiles struct {
+	P50 float64 `json:"p50"`
+	P90 float64 `json:"p90"`
+	P99 float64 `json:"p99"`
+	Max float64 `json:"max"`
+}
+
+func (s *runStats) summary() runSummary {
+	counts := make(map[string]int, len(s.statuses))
+	for status, n := range s.statuses {
+		counts[strconv.Itoa(status)] = n
+	}
+
+	sorted := append([]time.Duration{}, s.latencies...)
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i] < sorted[j] })
+	percentile := func(p float64) float64 {
+		if len(sorted) == 0 {
+			return 0
+		}
+		index := int(p*float64(len(sorted))+0.5) - 1
+		if index < 0 {
+			index = 0
+		}
+		return milliseconds(sorted[index])
+	}
+
+	summary := runSummary{
+		Processed:         s.processed,
+		OK:                s.ok,
+		Failed:            s.failed,
+		Skipped:           s.skipped,
+		Retries:           retryCount.Load(),
+		ElapsedMS:         time.Since(s.start).Milliseconds(),
+		StatusCounts:      counts,
+		OutcomeCounts:     s.outcomes,
+		InputLimitReached: readLimit.reached(),
+		LatencyPercentiles: latencyPercentiles{
+			P50: percentile(0.50),
+			P90: percentile(0.90),
+			P99: percentile(0.99),
+		},
+	}
+	if len(sorted) > 0 {
+		summary.LatencyPercentiles.Max = milliseconds(sorted[len(sorted)-1])
+	}
+	return summary
+}
+
+// milliseconds converts a duration to fractional milliseconds, rounded to
+// the microsecond.
+func milliseconds(d time.Duration) float64 {
+	return float64(d.Microseconds()) / 1000
+}
+
+// writeSummaryJSON writes the run summary as JSON to path, or to stderr if
+// path is "-".
+func writeSummaryJSON(path string, s *runStats) error {
+	data, err := json.Marshal(s.summary())
+	if err != nil {
+		return err
+	}
+	data = append(data, '\n')
+	if path == "-" {
+		_, err = os.Stderr.Write(data)
+		return err
+	}
+	if err := os.WriteFile(path, data, 0644); err != nil {
+		return fmt.Errorf("writing summary: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,115 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"text/template"
+	"text/template/parse"
+)
+
+// defaultOutputTemplate reproduces the standard status line.
+const defaultOutputTemplate = `Status: {{.statusText}}{{with .requestID}}, Request ID: {{.}}{{end}}, Response: {{.body}}`
+
+// templateFunctions are the helpers available to --output-template.
+var templateFunctions = template.FuncMap{
+	"json": func(v interface{}) (string, error) {
+		data, err := json.Marshal(v)
+		return string(data), err
+	},
+}
+
+// compileOutputTemplate parses the template used to print each response,
+// falling back to the standard status line.
+func compileOutputTemplate(text string) (*template.Template, error) {
+	if text == "" {
+		text = defaultOutputTemplate
+	}
+	return template.New("output").Funcs(templateFunctions).Parse(text)
+}
+
+// writeOutputLine renders the output template for a response and writes
+// it, followed by a newline, to the output. The line is written all at
+// once, so it's never interleaved with other output or seen half-written.
+func writeOutputLine(tmpl *template.Template, data map[string]interface{}) error {
+	var buf bytes.Buffer
+	if err := tmpl.Execute(&buf, data); err != nil {
+		return fmt.Errorf("rendering output template: %w", err)
+	}
+	buf.WriteByte('\n')
+	_, err := output.Write(buf.Bytes())
+	return err
+}
+
+// renderBodyTemplate renders the --template-body template for a line, with
+// the input, environment, and --vars-file variables available as .Input,
+// .Env, and .Vars.
+func renderBodyTemplate(tmpl *template.Template, env map[string]interface{}) (string, error) {
+	var buf bytes.Buffer
+	data := map[string]interface{}{"Input": env["input"], "Env": env["env"], "Vars": env["vars"]}
+	if err := tmpl.Execute(&buf, data); err != nil {
+		return "", fmt.Errorf("rendering body template: %w", err)
+	}
+	return buf.String(), nil
+}
+
+// templateEnvKeys returns the environment variables a template references
+// as .Env.NAME or index .Env "NAME". Keys computed at runtime aren't found.
+func templateEnvKeys(tmpl *template.Template) []string {
+	var keys []string
+	var walk func(node parse.Node)
+	walk = func(node parse.Node) {
+		switch n := node.(type) {
+		case *parse.ListNode:
+			if n == nil {
+				return
+			}
+			for _, child := range n.Nodes {
+				walk(child)
+			}
+		case *parse.ActionNode:
+			walk(n.Pipe)
+		case *parse.IfNode:
+			walk(&n.BranchNode)
+		case *parse.RangeNode:
+			walk(&n.BranchNode)
+		case *parse.WithNode:
+			walk(&n.BranchNode)
+		case *parse.BranchNode:
+			walk(n.Pipe)
+			walk(n.List)
+			walk(n.ElseList)
+		case *parse.TemplateNode:
+			walk(n.Pipe)
+		case *parse.PipeNode:
+			if n == nil {
+				return
+			}
+			for _, cmd := range n.Cmds {
+				walk(cmd)
+			}
+		case *parse.CommandNode:
+			if len(n.Args) >= 3 {
+				fn, isIdent := n.Args[0].(*parse.IdentifierNode)
+				field, isField := n.Args[1].(*parse.FieldNode)
+				key, isString := n.Args[2].(*parse.StringNode)
+				if isIdent && fn.Ident == "index" && isField && isString && len(field.Ident) == 1 && field.Ident[0] == "Env" {
+					keys = append(keys, key.Text)
+				}
+			}
+			for _, arg := range n.Args {
+				walk(arg)
+			}
+		case *parse.FieldNode:
+			if len(n.Ident) >= 2 && n.Ident[0] == "Env" {
+				keys = append(keys, n.Ident[1])
+			}
+		}
+	}
+	for _, t := range tmpl.Templates() {
+		if t.Tree != nil {
+			walk(t.Tree.Root)
+		}
+	}
+	return keys
+}
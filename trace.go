@@ -0,0 +1,72 @@
+package main
+
+import (
+	"crypto/tls"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptrace"
+	"strings"
+	"time"
+)
+
+// requestTrace records when each phase of a request started and finished.
+type requestTrace struct {
+	start        time.Time
+	dnsStart     time.Time
+	dnsDone      time.Time
+	connectStart time.Time
+	connectDone  time.Time
+	tlsStart     time.Time
+	tlsDone      time.Time
+	gotConn      time.Time
+	firstByte    time.Time
+	reused       bool
+}
+
+// withTrace returns a copy of req that records its phase timings.
+func withTrace(req *http.Request) (*http.Request, *requestTrace) {
+	t := &requestTrace{start: time.Now()}
+	trace := &httptrace.ClientTrace{
+		DNSStart: func(httptrace.DNSStartInfo) { t.dnsStart = time.Now() },
+		DNSDone:  func(httptrace.DNSDoneInfo) { t.dnsDone = time.Now() },
+		ConnectStart: func(network, addr string) {
+			if t.connectStart.IsZero() {
+				t.connectStart = time.Now()
+			}
+		},
+		ConnectDone:       func(network, addr string, err error) { t.connectDone = time.Now() },
+		TLSHandshakeStart: func() { t.tlsStart = time.Now() },
+		TLSHandshakeDone:  func(tls.ConnectionState, error) { t.tlsDone = time.Now() },
+		GotConn: func(info httptrace.GotConnInfo) {
+			t.gotConn = time.Now()
+			t.reused = info.Reused
+		},
+		GotFirstResponseByte: func() { t.firstByte = time.Now() },
+	}
+	return req.WithContext(httptrace.WithClientTrace(req.Context(), trace)), t
+}
+
+// report writes the phase durations of the request.
+func (t *requestTrace) report(w io.Writer, req *http.Request) {
+	end := time.Now()
+	phases := []string{
+		"dns=" + phase(t.dnsStart, t.dnsDone),
+		"connect=" + phase(t.connectStart, t.connectDone),
+		"tls=" + phase(t.tlsStart, t.tlsDone),
+		"server=" + phase(t.gotConn, t.firstByte),
+		"transfer=" + phase(t.firstByte, end),
+		"total=" + end.Sub(t.start).String(),
+		fmt.Sprintf("reused=%t", t.reused),
+	}
+	fmt.Fprintf(w, "Trace: %s %s %s\n", req.Method, req.URL, strings.Join(phases, " "))
+}
+
+// phase returns the duration between start and end, or "-" if the phase
+// didn't happen.
+func phase(start, end time.Time) string {
+	if start.IsZero() || end.IsZero() {
+		return "-"
+	}
+	return end.Sub(start).String()
+}
@@ -0,0 +1,228 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/net/proxy"
+)
+
+// newClient builds the HTTP client used for all requests.
+func newClient() (*http.Client, error) {
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+
+	// The same settings as the default transport's dialer
+	dialer := &net.Dialer{Timeout: 30 * time.Second, KeepAlive: 30 * time.Second}
+	if dnsServer != "" {
+		resolver, err := dnsResolver(dnsServer)
+		if err != nil {
+			return nil, fmt.Errorf("--dns-server: %w", err)
+		}
+		dialer.Resolver = resolver
+		transport.DialContext = dialer.DialContext
+	}
+
+	if socks5Proxy != "" {
+		socksDialer, err := socks5Dialer(socks5Proxy, dialer)
+		if err != nil {
+			return nil, fmt.Errorf("--socks5: %w", err)
+		}
+		// Requests are tunneled through the SOCKS proxy rather than any
+		// HTTP proxy from the environment
+		transport.Proxy = nil
+		transport.DialContext = socksDialer.DialContext
+	}
+
+	if tlsMinVersion != "" || tlsMaxVersion != "" {
+		tlsConfig, err := tlsVersionConfig(tlsMinVersion, tlsMaxVersion)
+		if err != nil {
+			return nil, err
+		}
+		transport.TLSClientConfig = tlsConfig
+	}
+	if tlsServerName != "" {
+		// The certificate is verified against this name instead of the
+		// URL's host
+		if transport.TLSClientConfig == nil {
+			transport.TLSClientConfig = &tls.Config{}
+		}
+		transport.TLSClientConfig.ServerName = tlsServerName
+	}
+
+	if http1Only {
+		// A non-nil, empty TLSNextProto keeps the transport from
+		// upgrading TLS connections to HTTP/2
+		transport.ForceAttemptHTTP2 = false
+		transport.TLSNextProto = map[string]func(string, *tls.Conn) http.RoundTripper{}
+		if transport.TLSClientConfig == nil {
+			transport.TLSClientConfig = &tls.Config{}
+		}
+		transport.TLSClientConfig.NextProtos = []string{"http/1.1"}
+	}
+
+	var roundTripper http.RoundTripper = transport
+	if certFile != "" || len(certHosts) > 0 {
+		certs, err := loadClientCerts(certFile, keyFile, certHosts)
+		if err != nil {
+			return nil, err
+		}
+		if transport.TLSClientConfig == nil {
+			transport.TLSClientConfig = &tls.Config{}
+		}
+		transport.TLSClientConfig.GetClientCertificate = certs.get
+		roundTripper = certRoundTripper{next: transport}
+	}
+
+	if maxConnections > 0 {
+		transport.DialContext = limitConnections(transport, maxConnections, transport.DialContext)
+	}
+
+	client := &http.Client{Transport: roundTripper}
+	if len(preserveAuthHosts) > 0 {
+		client.CheckRedirect = preserveAuthRedirect(preserveAuthHosts)
+	}
+	return client, nil
+}
+
+// dialFunc is the signature of http.Transport.DialContext.
+type dialFunc func(ctx context.Context, network, addr string) (net.Conn, error)
+
+// limitConnections wraps dial so that at most n connections made by
+// transport are open at once. When the limit is reached, idle keep-alive
+// connections are closed to make room before waiting for one to be closed.
+func limitConnections(transport *http.Transport, n int, dial dialFunc) dialFunc {
+	slots := make(chan struct{}, n)
+	return func(ctx context.Context, network, addr string) (net.Conn, error) {
+		select {
+		case slots <- struct{}{}:
+		default:
+			transport.CloseIdleConnections()
+			select {
+			case slots <- struct{}{}:
+			case <-ctx.Done():
+				return nil, ctx.Err()
+			}
+		}
+		conn, err := dial(ctx, network, addr)
+		if err != nil {
+			<-slots
+			return nil, err
+		}
+		return &limitedConn{Conn: conn, release: func() { <-slots }}, nil
+	}
+}
+
+// limitedConn frees its slot in limitConnections when it's closed.
+type limitedConn struct {
+	net.Conn
+	once    sync.Once
+	release func()
+}
+
+func (c *limitedConn) Close() error {
+	err := c.Conn.Close()
+	c.once.Do(c.release)
+	return err
+}
+
+// maxRedirects matches the limit of Go's default redirect policy.
+const maxRedirects = 10
+
+// preserveAuthRedirect returns a redirect policy that keeps the original
+// Authorization header when following a redirect to one of hosts. Go drops
+// it on redirects to any other host, which remains the behavior for hosts
+// not in the list.
+func preserveAuthRedirect(hosts []string) func(*http.Request, []*http.Request) error {
+	trusted := make(map[string]bool, len(hosts))
+	for _, host := range hosts {
+		trusted[strings.ToLower(host)] = true
+	}
+
+	return func(req *http.Request, via []*http.Request) error {
+		if len(via) >= maxRedirects {
+			return fmt.Errorf("stopped after %d redirects", maxRedirects)
+		}
+		auth := via[0].Header.Get("Authorization")
+		host := strings.ToLower(req.URL.Host)
+		if auth != "" && req.Header.Get("Authorization") == "" && (trusted[host] || trusted[strings.ToLower(req.URL.Hostname())]) {
+			req.Header.Set("Authorization", auth)
+		}
+		return nil
+	}
+}
+
+// tlsVersions maps the accepted --tls-min-version and --tls-max-version
+// values to TLS versions.
+var tlsVersions = map[string]uint16{
+	"1.0": tls.VersionTLS10,
+	"1.1": tls.VersionTLS11,
+	"1.2": tls.VersionTLS12,
+	"1.3": tls.VersionTLS13,
+}
+
+// tlsVersionConfig returns a TLS config limited to the given version range.
+// An empty version leaves that end of the range at Go's default.
+func tlsVersionConfig(min, max string) (*tls.Config, error) {
+	config := &tls.Config{}
+	var ok bool
+	if min != "" {
+		if config.MinVersion, ok = tlsVersions[min]; !ok {
+			return nil, fmt.Errorf("--tls-min-version: unknown TLS version %q", min)
+		}
+	}
+	if max != "" {
+		if config.MaxVersion, ok = tlsVersions[max]; !ok {
+			return nil, fmt.Errorf("--tls-max-version: unknown TLS version %q", max)
+		}
+	}
+	if config.MinVersion != 0 && config.MaxVersion != 0 && config.MinVersion > config.MaxVersion {
+		return nil, fmt.Errorf("--tls-min-version %s is greater than --tls-max-version %s", min, max)
+	}
+	return config, nil
+}
+
+// socks5Dialer returns a dialer that connects through the SOCKS5 proxy at
+// addr, given as host:port or user:pass@host:port, reaching the proxy with
+// forward.
+func socks5Dialer(addr string, forward proxy.Dialer) (proxy.ContextDialer, error) {
+	var auth *proxy.Auth
+	if at := strings.LastIndex(addr, "@"); at >= 0 {
+		user, password, _ := strings.Cut(addr[:at], ":")
+		auth = &proxy.Auth{User: user, Password: password}
+		addr = addr[at+1:]
+	}
+
+	dialer, err := proxy.SOCKS5("tcp", addr, auth, forward)
+	if err != nil {
+		return nil, err
+	}
+	contextDialer, ok := dialer.(proxy.ContextDialer)
+	if !ok {
+		return nil, fmt.Errorf("SOCKS5 dialer does not support contexts")
+	}
+	return contextDialer, nil
+}
+
+// dnsResolver returns a resolver that sends all queries to server, a
+// host:port or a host to query on port 53.
+func dnsResolver(server string) (*net.Resolver, error) {
+	if _, _, err := net.SplitHostPort(server); err != nil {
+		server = net.JoinHostPort(server, "53")
+		if _, _, err := net.SplitHostPort(server); err != nil {
+			return nil, fmt.Errorf("invalid DNS server %q", server)
+		}
+	}
+	return &net.Resolver{
+		PreferGo: true,
+		Dial: func(ctx context.Context, network, address string) (net.Conn, error) {
+			var d net.Dialer
+			return d.DialContext(ctx, network, server)
+		},
+	}, nil
+}
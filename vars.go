@@ -0,0 +1,42 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+// varsValue is exposed to every line's expressions as vars. Without
+// --vars-file it's an empty object, so vars.name ?? "default" works.
+var varsValue interface{} = map[string]interface{}{}
+
+// loadVars reads the variables in a --vars-file, an object in JSON if the
+// file ends in .json and YAML otherwise.
+func loadVars(path string) (map[string]interface{}, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("reading vars file: %w", err)
+	}
+
+	var values interface{}
+	if strings.EqualFold(filepath.Ext(path), ".json") {
+		err = json.Unmarshal(data, &values)
+	} else {
+		err = yaml.Unmarshal(data, &values)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("parsing vars file %s: %w", path, err)
+	}
+	if values == nil {
+		return map[string]interface{}{}, nil
+	}
+	vars, ok := values.(map[string]interface{})
+	if !ok {
+		return nil, fmt.Errorf("vars file %s must contain an object, not %s", path, describeKind(jsonKind(values)))
+	}
+	return vars, nil
+}